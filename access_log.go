@@ -0,0 +1,473 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Socket HAProxy sends log records to
+	HaproxyLogSocket = "/var/lib/load-balancer-servo/haproxy.sock"
+
+	// Prefix for HAProxy log records in httplog format
+	HaproxyLogFormatPrefix = "httplog"
+
+	// Timestamp layout for access log entries
+	AccessLogTimestampLayout = "2006-01-02T15:04:05.000000Z"
+
+	// Timestamp layout for the end time in access log file names
+	AccessLogEndTimeLayout = "20060102T1504Z"
+
+	// Name of the current (unrotated) access log file
+	AccessLogCurrentFile = "access-log.current"
+
+	// Directory under the log directory for rotated access log files
+	AccessLogSpoolDirectory = "access-log-spool"
+
+	// Default interval for access log rotation in minutes
+	DefaultAccessLogEmitInterval = 60
+
+	// Account number to use when not available from the load balancer
+	DefaultAccountNumber = "000000000000"
+)
+
+// AccessLogs is the access log writer for the load balancer
+var AccessLogs = NewAccessLogWriter()
+
+// HaproxyLogRecord is a parsed HAProxy httplog record
+// Times are in milliseconds and are -1 when not available.
+type HaproxyLogRecord struct {
+	Timestamp        time.Time
+	ClientIp         string
+	ClientPort       int
+	ServerIp         string
+	ServerPort       int
+	RequestTime      int64
+	QueueTime        int64
+	ConnectTime      int64
+	ResponseTime     int64
+	TotalTime        int64
+	StatusCode       int
+	BytesUploaded    int64
+	BytesRead        int64
+	Frontend         string
+	Backend          string
+	Server           string
+	TerminationState string
+	Request          string
+	CapturedHeaders  string
+}
+
+// AccessLogConfiguration is the load balancer access log configuration
+type AccessLogConfiguration struct {
+	Enabled          bool
+	LoadBalancerName string
+	DNSName          string
+	AccountNumber    string
+	EmitInterval     int32
+	S3BucketName     string
+	S3BucketPrefix   string
+}
+
+// AccessLogWriter writes ELB format access log entries
+// Entries are written to the current file in the log directory and the
+// file is rotated to the spool directory at the end of each emit interval.
+// Rotated files are spooled by bucket and object key, files are discarded
+// when there is no bucket to upload to.
+type AccessLogWriter struct {
+	mutex         sync.Mutex
+	Directory     string
+	Address       string
+	Configuration AccessLogConfiguration
+	Rotated       func(spoolPath string)
+	file          *os.File
+	entries       int
+	periodEnd     time.Time
+}
+
+// HaproxyLogListener receives HAProxy log records from a unix socket
+type HaproxyLogListener struct {
+	Conn      net.PacketConn
+	Consumers []func(*HaproxyLogRecord)
+}
+
+// ActivityHandler implementation that configures access logging
+type AccessLogHandler struct {
+	Writer *AccessLogWriter
+}
+
+var accountNumberRegexp = regexp.MustCompile(`-([0-9]{12})\.`)
+
+// Parse an HAProxy syslog line in httplog format
+// The line format must match the configured log-format:
+//
+//	httplog %Ts %ci %cp %si %sp %Tq %Tw %Tc %Tr %Tt %ST %U %B %f %b %s %ts %r %hrl
+func HaproxyLogRecordString(line string) (record *HaproxyLogRecord, err error) {
+	formatIndex := strings.Index(line, HaproxyLogFormatPrefix+" ")
+	if formatIndex < 0 {
+		return nil, errors.New("not an httplog record")
+	}
+	fields := strings.SplitN(strings.TrimSpace(line[formatIndex+len(HaproxyLogFormatPrefix)+1:]), " ", 18)
+	if len(fields) < 17 {
+		return nil, errors.New(fmt.Sprintf("invalid httplog record, fields %d", len(fields)))
+	}
+	integers := make([]int64, 13)
+	for index, field := range fields[:13] {
+		if index == 1 || index == 3 || (index == 4 && field == "-") {
+			continue
+		}
+		if integers[index], err = strconv.ParseInt(field, 10, 64); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid httplog record field %d: %s", index, field))
+		}
+	}
+	record = &HaproxyLogRecord{
+		Timestamp:        time.Unix(integers[0], 0).UTC(),
+		ClientIp:         fields[1],
+		ClientPort:       int(integers[2]),
+		ServerIp:         fields[3],
+		ServerPort:       int(integers[4]),
+		RequestTime:      integers[5],
+		QueueTime:        integers[6],
+		ConnectTime:      integers[7],
+		ResponseTime:     integers[8],
+		TotalTime:        integers[9],
+		StatusCode:       int(integers[10]),
+		BytesUploaded:    integers[11],
+		BytesRead:        integers[12],
+		Frontend:         fields[13],
+		Backend:          fields[14],
+		Server:           fields[15],
+		TerminationState: fields[16],
+	}
+	if len(fields) > 17 {
+		requestFields := strings.SplitN(fields[17], " ", 4)
+		if len(requestFields) >= 3 && strings.HasPrefix(requestFields[2], "HTTP/") {
+			record.Request = strings.Join(requestFields[:3], " ")
+			if len(requestFields) > 3 {
+				record.CapturedHeaders = strings.TrimSpace(requestFields[3])
+			}
+		} else {
+			record.Request = strings.TrimSpace(fields[17])
+		}
+	}
+	return
+}
+
+// Check if the record has a backend server
+func (record *HaproxyLogRecord) HasServer() bool {
+	return record.Server != "" && record.Server != "<NOSRV>" && record.ServerIp != "-"
+}
+
+// The request line with an absolute URI as used by ELB access logs
+// The protocol and port are taken from the frontend name (e.g. http-8080)
+func (record *HaproxyLogRecord) RequestLine(host string) string {
+	requestFields := strings.SplitN(record.Request, " ", 3)
+	frontendFields := strings.SplitN(record.Frontend, "-", 2)
+	if len(requestFields) != 3 || !strings.HasPrefix(requestFields[1], "/") || len(frontendFields) != 2 {
+		return record.Request
+	}
+	return fmt.Sprintf("%s %s://%s:%s%s %s",
+		requestFields[0], frontendFields[0], host, frontendFields[1], requestFields[1], requestFields[2])
+}
+
+// Format the record as an ELB access log entry
+//
+//	timestamp elb client:port backend:port request_processing_time
+//	backend_processing_time response_processing_time elb_status_code
+//	backend_status_code received_bytes sent_bytes "request"
+func FormatAccessLogEntry(configuration *AccessLogConfiguration, record *HaproxyLogRecord) string {
+	backend := "-"
+	backendStatus := "-"
+	requestTime := "-1"
+	backendTime := "-1"
+	responseTime := "-1"
+	if record.HasServer() {
+		backend = fmt.Sprintf("%s:%d", record.ServerIp, record.ServerPort)
+		backendStatus = strconv.Itoa(record.StatusCode)
+		if record.QueueTime >= 0 && record.ConnectTime >= 0 && record.ResponseTime >= 0 {
+			transferTime := record.TotalTime - record.RequestTime - record.QueueTime - record.ConnectTime - record.ResponseTime
+			if transferTime < 0 {
+				transferTime = 0
+			}
+			requestTime = accessLogSeconds(record.QueueTime + record.ConnectTime)
+			backendTime = accessLogSeconds(record.ResponseTime)
+			responseTime = accessLogSeconds(transferTime)
+		}
+	}
+	host := configuration.DNSName
+	if host == "" {
+		host = configuration.LoadBalancerName
+	}
+	return fmt.Sprintf("%s %s %s:%d %s %s %s %s %d %s %d %d \"%s\"\n",
+		record.Timestamp.UTC().Format(AccessLogTimestampLayout),
+		configuration.LoadBalancerName,
+		record.ClientIp, record.ClientPort,
+		backend,
+		requestTime, backendTime, responseTime,
+		record.StatusCode, backendStatus,
+		record.BytesUploaded, record.BytesRead,
+		record.RequestLine(host))
+}
+
+func accessLogSeconds(milliseconds int64) string {
+	return fmt.Sprintf("%.6f", float64(milliseconds)/1000)
+}
+
+// The account number for a load balancer from its DNS name
+// Load balancer DNS names are of the form NAME-ACCOUNT.lb.DOMAIN
+func AccountNumber(dnsName string) string {
+	if match := accountNumberRegexp.FindStringSubmatch(dnsName); match != nil {
+		return match[1]
+	}
+	return DefaultAccountNumber
+}
+
+// The access log file name for a period using the ELB naming scheme
+//
+//	ACCOUNT_elasticloadbalancing_REGION_NAME_ENDTIME_IP_RANDOM.log
+func AccessLogFileName(configuration *AccessLogConfiguration, address string, endTime time.Time) string {
+	randomBytes := make([]byte, 4)
+	_, _ = rand.Read(randomBytes)
+	return fmt.Sprintf("%s_elasticloadbalancing_%s_%s_%s_%s_%x.log",
+		configuration.AccountNumber,
+		EucalyptusRegion,
+		configuration.LoadBalancerName,
+		endTime.UTC().Format(AccessLogEndTimeLayout),
+		address,
+		randomBytes)
+}
+
+// The object key for an access log file using the ELB layout
+//
+//	PREFIX/AWSLogs/ACCOUNT/elasticloadbalancing/REGION/YYYY/MM/DD/FILENAME
+func AccessLogObjectKey(configuration *AccessLogConfiguration, endTime time.Time, fileName string) string {
+	key := fmt.Sprintf("AWSLogs/%s/elasticloadbalancing/%s/%s/%s",
+		configuration.AccountNumber,
+		EucalyptusRegion,
+		endTime.UTC().Format("2006/01/02"),
+		fileName)
+	prefix := strings.Trim(configuration.S3BucketPrefix, "/")
+	if prefix != "" {
+		key = prefix + "/" + key
+	}
+	return key
+}
+
+func NewAccessLogWriter() *AccessLogWriter {
+	return &AccessLogWriter{}
+}
+
+// The directory rotated access log files are spooled to
+func (writer *AccessLogWriter) SpoolDirectory() string {
+	return filepath.Join(writer.Directory, AccessLogSpoolDirectory)
+}
+
+// Update the access log configuration
+// Changes to the load balancer or emit interval rotate the current file.
+func (writer *AccessLogWriter) Configure(configuration AccessLogConfiguration, timeNow time.Time) error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if configuration.EmitInterval != 5 && configuration.EmitInterval != 60 {
+		configuration.EmitInterval = DefaultAccessLogEmitInterval
+	}
+	previous := writer.Configuration
+	if previous.LoadBalancerName != configuration.LoadBalancerName ||
+		previous.EmitInterval != configuration.EmitInterval ||
+		(previous.Enabled && !configuration.Enabled) {
+		if err := writer.rotate(timeNow); err != nil {
+			return err
+		}
+		writer.periodEnd = time.Time{}
+	}
+	writer.Configuration = configuration
+	return nil
+}
+
+// Write an access log entry for the record
+func (writer *AccessLogWriter) Write(record *HaproxyLogRecord, timeNow time.Time) error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if !writer.Configuration.Enabled {
+		return nil
+	}
+	if err := writer.maintain(timeNow); err != nil {
+		return err
+	}
+	if writer.file == nil {
+		if err := os.MkdirAll(writer.Directory, 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(filepath.Join(writer.Directory, AccessLogCurrentFile),
+			os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		writer.file = file
+	}
+	_, err := writer.file.WriteString(FormatAccessLogEntry(&writer.Configuration, record))
+	if err == nil {
+		writer.entries++
+	}
+	return err
+}
+
+// Rotate the current file if the emit interval has ended
+func (writer *AccessLogWriter) Maintain(timeNow time.Time) error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	return writer.maintain(timeNow)
+}
+
+// Rotate the current file and stop writing
+func (writer *AccessLogWriter) Close(timeNow time.Time) error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	return writer.rotate(timeNow)
+}
+
+func (writer *AccessLogWriter) maintain(timeNow time.Time) error {
+	interval := time.Duration(writer.Configuration.EmitInterval) * time.Minute
+	if interval <= 0 {
+		return nil
+	}
+	if writer.periodEnd.IsZero() {
+		writer.periodEnd = timeNow.Truncate(interval).Add(interval)
+	} else if !timeNow.Before(writer.periodEnd) {
+		if err := writer.rotate(writer.periodEnd); err != nil {
+			return err
+		}
+		writer.periodEnd = timeNow.Truncate(interval).Add(interval)
+	}
+	return nil
+}
+
+// Move the current file to the spool directory, empty files and files
+// without a bucket are discarded
+func (writer *AccessLogWriter) rotate(endTime time.Time) error {
+	if writer.file == nil {
+		return nil
+	}
+	currentPath := writer.file.Name()
+	err := writer.file.Close()
+	writer.file = nil
+	entries := writer.entries
+	writer.entries = 0
+	if err != nil {
+		return err
+	}
+	if entries == 0 {
+		return os.Remove(currentPath)
+	}
+	if writer.Configuration.S3BucketName == "" {
+		logger.Printf("WARNING Discarding %d access log entries, no bucket configured\n", entries)
+		return os.Remove(currentPath)
+	}
+	fileName := AccessLogFileName(&writer.Configuration, writer.Address, endTime)
+	spoolPath := filepath.Join(writer.SpoolDirectory(), writer.Configuration.S3BucketName,
+		filepath.FromSlash(AccessLogObjectKey(&writer.Configuration, endTime, fileName)))
+	if err = os.MkdirAll(filepath.Dir(spoolPath), 0755); err != nil {
+		return err
+	}
+	if err = os.Rename(currentPath, spoolPath); err != nil {
+		return err
+	}
+	if writer.Rotated != nil {
+		writer.Rotated(spoolPath)
+	}
+	return nil
+}
+
+// Create a listener for HAProxy log records on the given unix socket
+func NewHaproxyLogListener(socketPath string, consumers ...func(*HaproxyLogRecord)) (*HaproxyLogListener, error) {
+	_ = os.Remove(socketPath)
+	conn, err := net.ListenPacket("unixgram", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return &HaproxyLogListener{conn, consumers}, nil
+}
+
+// Receive and dispatch log records until the listener is closed
+func (listener *HaproxyLogListener) Serve() {
+	buffer := make([]byte, 64*1024)
+	for {
+		length, _, err := listener.Conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		record, err := HaproxyLogRecordString(string(buffer[:length]))
+		if err != nil {
+			continue
+		}
+		for _, consumer := range listener.Consumers {
+			consumer(record)
+		}
+	}
+}
+
+func (listener *HaproxyLogListener) Close() {
+	_ = listener.Conn.Close()
+}
+
+// Create an ActivityHandler that configures access logging
+func NewAccessLogHandler(writer *AccessLogWriter) ActivityHandler {
+	return &AccessLogHandler{writer}
+}
+
+func (handler *AccessLogHandler) Send(name string, value string) error {
+	switch name {
+	case "set-loadbalancer":
+		return handler.HandleLoadBalancer(value)
+	}
+	return nil
+}
+
+func (handler *AccessLogHandler) Receive(_ string) (*string, error) {
+	return nil, errors.New("not supported")
+}
+
+func (handler *AccessLogHandler) Close() {
+}
+
+func (handler *AccessLogHandler) HandleLoadBalancer(loadBalancer string) error {
+	activityDescriptions, err := ActivityDescriptionsString(loadBalancer)
+	if err != nil || len(activityDescriptions.LoadBalancers) != 1 {
+		return err
+	}
+	activityLoadBalancer := activityDescriptions.LoadBalancers[0]
+	attributes := activityLoadBalancer.LoadBalancerAttributes
+	return handler.Writer.Configure(AccessLogConfiguration{
+		Enabled:          attributes.AccessLog,
+		LoadBalancerName: activityLoadBalancer.LoadBalancerName,
+		DNSName:          activityLoadBalancer.DNSName,
+		AccountNumber:    AccountNumber(activityLoadBalancer.DNSName),
+		EmitInterval:     attributes.AccessLogEmitInterval,
+		S3BucketName:     attributes.AccessLogS3BucketName,
+		S3BucketPrefix:   attributes.AccessLogS3BucketPrefix,
+	}, time.Now())
+}
+
+// The first non-loopback IPv4 address for the host
+func LocalAddress() string {
+	addresses, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, address := range addresses {
+			if ipNet, ok := address.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				return ipNet.IP.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
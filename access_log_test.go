@@ -0,0 +1,170 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+const (
+	ExampleHaproxyLogRecord = `<150>Apr  2 16:18:19 haproxy[1532]: httplog 1585844299 10.111.1.1 54321 10.111.10.215 8080 2 0 1 5 10 200 120 512 http-8080 backend-http-8080 http-8080 ---- GET /index.html HTTP/1.1 `
+
+	ExampleHaproxyLogRecordNoServer = `<150>Apr  2 16:18:19 haproxy[1532]: httplog 1585844299 10.111.1.1 54322 - - 2 -1 -1 -1 2 503 80 212 http-8080 backend-http-8080 <NOSRV> SC-- GET / HTTP/1.1 `
+)
+
+func exampleAccessLogConfiguration() AccessLogConfiguration {
+	return AccessLogConfiguration{
+		Enabled:          true,
+		LoadBalancerName: "balancer-1",
+		DNSName:          "balancer-1-000174477311.lb.box3-10-111-10-63.euca.me",
+		AccountNumber:    "000174477311",
+		EmitInterval:     5,
+	}
+}
+
+func TestHaproxyLogRecordRead(t *testing.T) {
+	record, err := HaproxyLogRecordString(ExampleHaproxyLogRecord)
+	if err != nil {
+		t.Fatalf("HaproxyLogRecordString(ExampleHaproxyLogRecord) error; %s", err.Error())
+	}
+	assert.Equal(t, time.Unix(1585844299, 0).UTC(), record.Timestamp, "record.Timestamp")
+	assert.Equal(t, "10.111.1.1", record.ClientIp, "record.ClientIp")
+	assert.Equal(t, 54321, record.ClientPort, "record.ClientPort")
+	assert.Equal(t, int64(5), record.ResponseTime, "record.ResponseTime")
+	assert.Equal(t, 200, record.StatusCode, "record.StatusCode")
+	assert.Equal(t, "http-8080", record.Server, "record.Server")
+	assert.Equal(t, "GET /index.html HTTP/1.1", record.Request, "record.Request")
+
+	_, err = HaproxyLogRecordString("<150>Apr  2 16:18:19 haproxy[1532]: Proxy http-8080 started.")
+	assert.Error(t, err, "HaproxyLogRecordString(not httplog)")
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	configuration := exampleAccessLogConfiguration()
+	record, err := HaproxyLogRecordString(ExampleHaproxyLogRecord)
+	if err != nil {
+		t.Fatalf("HaproxyLogRecordString(ExampleHaproxyLogRecord) error; %s", err.Error())
+	}
+	assert.Equal(t,
+		`2020-04-02T16:18:19.000000Z balancer-1 10.111.1.1:54321 10.111.10.215:8080 0.001000 0.005000 0.002000 200 200 120 512 "GET http://balancer-1-000174477311.lb.box3-10-111-10-63.euca.me:8080/index.html HTTP/1.1"`+"\n",
+		FormatAccessLogEntry(&configuration, record), "FormatAccessLogEntry(ExampleHaproxyLogRecord)")
+
+	record, err = HaproxyLogRecordString(ExampleHaproxyLogRecordNoServer)
+	if err != nil {
+		t.Fatalf("HaproxyLogRecordString(ExampleHaproxyLogRecordNoServer) error; %s", err.Error())
+	}
+	assert.Equal(t,
+		`2020-04-02T16:18:19.000000Z balancer-1 10.111.1.1:54322 - -1 -1 -1 503 - 80 212 "GET http://balancer-1-000174477311.lb.box3-10-111-10-63.euca.me:8080/ HTTP/1.1"`+"\n",
+		FormatAccessLogEntry(&configuration, record), "FormatAccessLogEntry(ExampleHaproxyLogRecordNoServer)")
+}
+
+func TestAccessLogFileName(t *testing.T) {
+	assert.Equal(t, "000174477311", AccountNumber("balancer-1-000174477311.lb.box3-10-111-10-63.euca.me"), "AccountNumber")
+	assert.Equal(t, DefaultAccountNumber, AccountNumber("balancer-1.lb.euca.me"), "AccountNumber(no account)")
+
+	configuration := exampleAccessLogConfiguration()
+	endTime := time.Date(2020, 4, 2, 16, 20, 0, 0, time.UTC)
+	assert.Regexp(t,
+		regexp.MustCompile(`^000174477311_elasticloadbalancing_eucalyptus_balancer-1_20200402T1620Z_10\.111\.10\.63_[0-9a-f]{8}\.log$`),
+		AccessLogFileName(&configuration, "10.111.10.63", endTime), "AccessLogFileName")
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	logDirectory, err := ioutil.TempDir("", "access-log")
+	if err != nil {
+		t.Fatalf("TempDir error; %s", err.Error())
+	}
+	defer os.RemoveAll(logDirectory)
+
+	record, err := HaproxyLogRecordString(ExampleHaproxyLogRecord)
+	if err != nil {
+		t.Fatalf("HaproxyLogRecordString(ExampleHaproxyLogRecord) error; %s", err.Error())
+	}
+	writer := NewAccessLogWriter()
+	writer.Directory = logDirectory
+	writer.Address = "10.111.10.63"
+	startTime := time.Date(2020, 4, 2, 16, 18, 19, 0, time.UTC)
+	configuration := exampleAccessLogConfiguration()
+	configuration.S3BucketName = "bucket-1"
+	err = writer.Configure(configuration, startTime)
+	if err != nil {
+		t.Fatalf("Configure error; %s", err.Error())
+	}
+	spoolDirectory := filepath.Join(writer.SpoolDirectory(), "bucket-1",
+		filepath.FromSlash(path.Dir(AccessLogObjectKey(&configuration, startTime, "access.log"))))
+	for _, offset := range []time.Duration{0, time.Second, time.Minute} {
+		if err = writer.Write(record, startTime.Add(offset)); err != nil {
+			t.Fatalf("Write error; %s", err.Error())
+		}
+	}
+	spooled, _ := filepath.Glob(filepath.Join(spoolDirectory, "*.log"))
+	assert.Equal(t, 0, len(spooled), "spooled files before interval end")
+
+	if err = writer.Maintain(startTime.Add(2 * time.Minute)); err != nil {
+		t.Fatalf("Maintain error; %s", err.Error())
+	}
+	spooled, _ = filepath.Glob(filepath.Join(spoolDirectory, "*_20200402T1620Z_*.log"))
+	if assert.Equal(t, 1, len(spooled), "spooled files after interval end") {
+		data, err := ioutil.ReadFile(spooled[0])
+		if err != nil {
+			t.Fatalf("ReadFile error; %s", err.Error())
+		}
+		assert.Equal(t, 3, len(regexp.MustCompile("\n").FindAll(data, -1)), "spooled entries")
+	}
+
+	// empty intervals are not spooled
+	if err = writer.Maintain(startTime.Add(10 * time.Minute)); err != nil {
+		t.Fatalf("Maintain error; %s", err.Error())
+	}
+	if err = writer.Write(record, startTime.Add(11*time.Minute)); err != nil {
+		t.Fatalf("Write error; %s", err.Error())
+	}
+	if err = writer.Close(startTime.Add(12 * time.Minute)); err != nil {
+		t.Fatalf("Close error; %s", err.Error())
+	}
+	spooled, _ = filepath.Glob(filepath.Join(spoolDirectory, "*.log"))
+	assert.Equal(t, 2, len(spooled), "spooled files after close")
+}
+
+// Access logs are not spooled when there is no bucket to upload to
+func TestAccessLogRotationNoBucket(t *testing.T) {
+	logDirectory, err := ioutil.TempDir("", "access-log")
+	if err != nil {
+		t.Fatalf("TempDir error; %s", err.Error())
+	}
+	defer os.RemoveAll(logDirectory)
+
+	record, err := HaproxyLogRecordString(ExampleHaproxyLogRecord)
+	if err != nil {
+		t.Fatalf("HaproxyLogRecordString(ExampleHaproxyLogRecord) error; %s", err.Error())
+	}
+	writer := NewAccessLogWriter()
+	writer.Directory = logDirectory
+	writer.Address = "10.111.10.63"
+	startTime := time.Date(2020, 4, 2, 16, 18, 19, 0, time.UTC)
+	if err = writer.Configure(exampleAccessLogConfiguration(), startTime); err != nil {
+		t.Fatalf("Configure error; %s", err.Error())
+	}
+	if err = writer.Write(record, startTime); err != nil {
+		t.Fatalf("Write error; %s", err.Error())
+	}
+	if err = writer.Close(startTime.Add(2 * time.Minute)); err != nil {
+		t.Fatalf("Close error; %s", err.Error())
+	}
+	var logFiles []string
+	_ = filepath.Walk(logDirectory, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			logFiles = append(logFiles, path)
+		}
+		return nil
+	})
+	assert.Empty(t, logFiles, "log files without bucket")
+}
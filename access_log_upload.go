@@ -0,0 +1,208 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Initial delay before retrying a failed access log upload
+	AccessLogUploadMinBackoff = 10 * time.Second
+
+	// Maximum delay before retrying a failed access log upload
+	AccessLogUploadMaxBackoff = 10 * time.Minute
+
+	// Interval for checking the spool directory for access logs to upload
+	AccessLogUploadInterval = 30 * time.Second
+)
+
+// AccessLogUploader uploads spooled access log files to object storage
+// Spooled files are laid out as BUCKET/KEY under the spool directory and
+// are only removed once the upload is confirmed.
+type AccessLogUploader struct {
+	mutex          sync.Mutex
+	Client         s3iface.S3API
+	SpoolDirectory string
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+	failures       map[string]accessLogUploadFailure
+	notify         chan struct{}
+}
+
+type accessLogUploadFailure struct {
+	attempts  uint
+	nextRetry time.Time
+}
+
+// Create an S3 client for the given endpoint and region.
+// Path style addressing is used as required for the Eucalyptus object
+// storage gateway.
+func NewS3Client(endpoint string, region string) (s3iface.S3API, error) {
+	sess, err := NewAwsSession(endpoint, region, &aws.Config{
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+// Create an uploader for files in the given spool directory
+func NewAccessLogUploader(client s3iface.S3API, spoolDirectory string) *AccessLogUploader {
+	return &AccessLogUploader{
+		Client:         client,
+		SpoolDirectory: spoolDirectory,
+		MinBackoff:     AccessLogUploadMinBackoff,
+		MaxBackoff:     AccessLogUploadMaxBackoff,
+		failures:       map[string]accessLogUploadFailure{},
+		notify:         make(chan struct{}, 1),
+	}
+}
+
+// Request an upload of spooled files, e.g. following rotation
+func (uploader *AccessLogUploader) Notify(_ string) {
+	select {
+	case uploader.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Upload spooled files when notified or periodically
+func (uploader *AccessLogUploader) Run() {
+	ticker := time.NewTicker(AccessLogUploadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-uploader.notify:
+		}
+		uploader.Upload(time.Now())
+	}
+}
+
+// Create the client, then upload spooled files when notified or
+// periodically. Client creation is retried with backoff, files spooled
+// while there is no client are uploaded once it is created.
+func (uploader *AccessLogUploader) RunWithClient(newClient func() (s3iface.S3API, error)) {
+	uploader.createClient(newClient, time.Sleep)
+	uploader.Run()
+}
+
+func (uploader *AccessLogUploader) createClient(newClient func() (s3iface.S3API, error), sleep func(time.Duration)) {
+	for attempts := uint(1); ; attempts++ {
+		client, err := newClient()
+		if err == nil {
+			uploader.mutex.Lock()
+			uploader.Client = client
+			uploader.mutex.Unlock()
+			return
+		}
+		backoff := uploader.backoff(attempts)
+		logger.Printf("Error creating access log upload client (attempt %d, retry in %s) %s\n",
+			attempts, backoff, err.Error())
+		sleep(backoff)
+	}
+}
+
+// Upload all spooled files that are not waiting to be retried
+// Returns the number of files uploaded.
+func (uploader *AccessLogUploader) Upload(timeNow time.Time) int {
+	uploader.mutex.Lock()
+	defer uploader.mutex.Unlock()
+	uploaded := 0
+	spoolPaths := uploader.spooledFiles()
+	for failedPath := range uploader.failures {
+		if !containsString(spoolPaths, failedPath) {
+			delete(uploader.failures, failedPath)
+		}
+	}
+	for _, spoolPath := range spoolPaths {
+		failure, failed := uploader.failures[spoolPath]
+		if failed && timeNow.Before(failure.nextRetry) {
+			continue
+		}
+		err := uploader.uploadFile(spoolPath)
+		if err != nil {
+			failure.attempts++
+			failure.nextRetry = timeNow.Add(uploader.backoff(failure.attempts))
+			uploader.failures[spoolPath] = failure
+			logger.Printf("Error uploading access log %s (attempt %d, retry at %s) %s\n",
+				spoolPath, failure.attempts, failure.nextRetry.Format(time.RFC3339), err.Error())
+			continue
+		}
+		delete(uploader.failures, spoolPath)
+		if err = os.Remove(spoolPath); err != nil {
+			logger.Printf("Error removing uploaded access log %s\n", err.Error())
+		}
+		uploaded++
+	}
+	return uploaded
+}
+
+// Paths for files spooled by bucket and key
+func (uploader *AccessLogUploader) spooledFiles() []string {
+	var spoolPaths []string
+	_ = filepath.Walk(uploader.SpoolDirectory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Dir(path) == filepath.Clean(uploader.SpoolDirectory) {
+			return nil
+		}
+		spoolPaths = append(spoolPaths, path)
+		return nil
+	})
+	return spoolPaths
+}
+
+func (uploader *AccessLogUploader) uploadFile(spoolPath string) error {
+	relativePath, err := filepath.Rel(uploader.SpoolDirectory, spoolPath)
+	if err != nil {
+		return err
+	}
+	pathParts := strings.SplitN(filepath.ToSlash(relativePath), "/", 2)
+	if len(pathParts) != 2 {
+		return errors.New(fmt.Sprintf("invalid spool path %s", relativePath))
+	}
+	file, err := os.Open(spoolPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = uploader.Client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(pathParts[0]),
+		Key:         aws.String(pathParts[1]),
+		Body:        file,
+		ContentType: aws.String("text/plain"),
+	})
+	return err
+}
+
+// Exponential backoff for the given number of failed attempts
+func (uploader *AccessLogUploader) backoff(attempts uint) time.Duration {
+	backoff := uploader.MinBackoff
+	for attempt := uint(1); attempt < attempts && backoff < uploader.MaxBackoff; attempt++ {
+		backoff *= 2
+	}
+	if backoff > uploader.MaxBackoff {
+		backoff = uploader.MaxBackoff
+	}
+	return backoff
+}
+
+func containsString(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Object storage stand-in that accepts PUT requests
+type objectStorageStandIn struct {
+	mutex   sync.Mutex
+	fail    bool
+	objects map[string]string
+}
+
+func (standIn *objectStorageStandIn) setFail(fail bool) {
+	standIn.mutex.Lock()
+	defer standIn.mutex.Unlock()
+	standIn.fail = fail
+}
+
+func (standIn *objectStorageStandIn) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	standIn.mutex.Lock()
+	defer standIn.mutex.Unlock()
+	if request.Method != http.MethodPut || standIn.fail {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	data, _ := ioutil.ReadAll(request.Body)
+	standIn.objects[request.URL.Path] = string(data)
+	writer.WriteHeader(http.StatusOK)
+}
+
+func TestAccessLogUpload(t *testing.T) {
+	standIn := &objectStorageStandIn{objects: map[string]string{}}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	spoolDirectory, err := ioutil.TempDir("", "access-log-spool")
+	if err != nil {
+		t.Fatalf("TempDir error; %s", err.Error())
+	}
+	defer os.RemoveAll(spoolDirectory)
+	spoolPath := filepath.Join(spoolDirectory, "bucket", "prefix", "AWSLogs", "log.log")
+	if err = os.MkdirAll(filepath.Dir(spoolPath), 0755); err != nil {
+		t.Fatalf("MkdirAll error; %s", err.Error())
+	}
+	if err = ioutil.WriteFile(spoolPath, []byte("entry\n"), 0644); err != nil {
+		t.Fatalf("WriteFile error; %s", err.Error())
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(server.URL),
+		Region:           aws.String(EucalyptusRegion),
+		Credentials:      credentials.NewStaticCredentials("AKIAEXAMPLE", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatalf("NewSession error; %s", err.Error())
+	}
+	uploader := NewAccessLogUploader(s3.New(sess), spoolDirectory)
+	timeNow := time.Now()
+
+	standIn.setFail(true)
+	assert.Equal(t, 0, uploader.Upload(timeNow), "Upload() with failing storage")
+	_, err = os.Stat(spoolPath)
+	assert.NoError(t, err, "spooled file retained after failure")
+
+	standIn.setFail(false)
+	assert.Equal(t, 0, uploader.Upload(timeNow.Add(time.Second)), "Upload() during backoff")
+	assert.Equal(t, 1, uploader.Upload(timeNow.Add(AccessLogUploadMinBackoff)), "Upload() after backoff")
+	assert.Equal(t, map[string]string{"/bucket/prefix/AWSLogs/log.log": "entry\n"}, standIn.objects, "uploaded objects")
+	_, err = os.Stat(spoolPath)
+	assert.True(t, os.IsNotExist(err), "spooled file removed after upload")
+}
+
+func TestAccessLogUploadBackoff(t *testing.T) {
+	uploader := NewAccessLogUploader(nil, "")
+	assert.Equal(t, AccessLogUploadMinBackoff, uploader.backoff(1), "backoff(1)")
+	assert.Equal(t, 4*AccessLogUploadMinBackoff, uploader.backoff(3), "backoff(3)")
+	assert.Equal(t, AccessLogUploadMaxBackoff, uploader.backoff(100), "backoff(100)")
+	assert.Equal(t, "logs/AWSLogs/000174477311/elasticloadbalancing/eucalyptus/2020/04/02/log.log",
+		AccessLogObjectKey(&AccessLogConfiguration{AccountNumber: "000174477311", S3BucketPrefix: "/logs/"},
+			time.Date(2020, 4, 2, 16, 20, 0, 0, time.UTC), "log.log"), "AccessLogObjectKey")
+}
+
+// Client creation is retried with backoff until a client is created
+func TestAccessLogUploadCreateClient(t *testing.T) {
+	uploader := NewAccessLogUploader(nil, "")
+	client := s3.New(session.Must(session.NewSession(&aws.Config{Region: aws.String(EucalyptusRegion)})))
+	attempts := 0
+	var sleeps []time.Duration
+	uploader.createClient(func() (s3iface.S3API, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("no credentials")
+		}
+		return client, nil
+	}, func(backoff time.Duration) {
+		sleeps = append(sleeps, backoff)
+	})
+	assert.Equal(t, 3, attempts, "client creation attempts")
+	assert.Equal(t, []time.Duration{AccessLogUploadMinBackoff, 2 * AccessLogUploadMinBackoff}, sleeps, "retry backoff")
+	assert.Equal(t, client, uploader.Client, "created client")
+}
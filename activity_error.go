@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ActivityErrorCategory classifies an activity failure for the workflow
+type ActivityErrorCategory string
+
+const (
+	// A failure that may succeed if the activity is retried, such as a
+	// handler that is not available
+	ActivityErrorTransient ActivityErrorCategory = "transient"
+
+	// A failure due to an activity value that cannot be handled
+	ActivityErrorInvalidInput ActivityErrorCategory = "invalid-input"
+
+	// A failure due to a load balancer policy that is not yet available
+	ActivityErrorMissingPolicy ActivityErrorCategory = "missing-policy"
+
+	// Any other failure, errors that are not categorized are internal
+	ActivityErrorInternal ActivityErrorCategory = "internal"
+)
+
+const (
+	// Java exception for transient activity failures
+	TransientExceptionClass = "com.eucalyptus.loadbalancing.workflow.LoadBalancingTransientActivityException"
+
+	// Java exception for activity failures due to invalid input
+	InvalidInputExceptionClass = "com.eucalyptus.loadbalancing.workflow.LoadBalancingInvalidInputActivityException"
+
+	// Java exception for activity failures due to a missing policy
+	MissingPolicyExceptionClass = "com.eucalyptus.loadbalancing.workflow.LoadBalancingMissingPolicyActivityException"
+
+	// Category key for error responses
+	ExceptionCategory = "category"
+
+	// Retryable key for error responses
+	ExceptionRetryable = "retryable"
+)
+
+// ActivityError is an activity failure with a category
+type ActivityError struct {
+	Category ActivityErrorCategory
+	Err      error
+}
+
+// Create an error with the given category, nil if the error is nil
+// An error that is already categorized is not changed.
+func NewActivityError(category ActivityErrorCategory, err error) error {
+	if err == nil {
+		return nil
+	}
+	var activityErr *ActivityError
+	if errors.As(err, &activityErr) {
+		return err
+	}
+	return &ActivityError{category, err}
+}
+
+func (err *ActivityError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *ActivityError) Unwrap() error {
+	return err.Err
+}
+
+// Get the category for an activity failure
+// Context errors are transient, other errors that are not categorized are
+// internal. Wrapped errors are categorized by the wrapped error.
+func ActivityErrorCategoryOf(err error) ActivityErrorCategory {
+	var activityErr *ActivityError
+	if errors.As(err, &activityErr) {
+		return activityErr.Category
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return ActivityErrorTransient
+	}
+	return ActivityErrorInternal
+}
+
+// The Java exception class for the category
+func (category ActivityErrorCategory) ExceptionClass() string {
+	switch category {
+	case ActivityErrorTransient:
+		return TransientExceptionClass
+	case ActivityErrorInvalidInput:
+		return InvalidInputExceptionClass
+	case ActivityErrorMissingPolicy:
+		return MissingPolicyExceptionClass
+	}
+	return ExceptionClass
+}
+
+// True if an activity failing with the category may succeed on retry
+// A missing policy may be sent after the load balancer that uses it.
+func (category ActivityErrorCategory) Retryable() bool {
+	return category == ActivityErrorTransient || category == ActivityErrorMissingPolicy
+}
+
+// The failure reason for a message, the message prefixed with the category
+func (category ActivityErrorCategory) Reason(message string) string {
+	return fmt.Sprintf("%s: %s", category, message)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestActivityErrorCategory(t *testing.T) {
+	assert.Nil(t, NewActivityError(ActivityErrorTransient, nil), "nil error")
+	err := NewActivityError(ActivityErrorMissingPolicy, errors.New("policy not found"))
+	assert.Equal(t, "policy not found", err.Error(), "error message")
+	assert.Equal(t, ActivityErrorMissingPolicy, ActivityErrorCategoryOf(err), "missing policy category")
+	assert.Equal(t, ActivityErrorMissingPolicy, ActivityErrorCategoryOf(NewActivityError(ActivityErrorInternal, err)),
+		"category retained")
+	assert.Equal(t, ActivityErrorInternal, ActivityErrorCategoryOf(errors.New("error")), "uncategorized error")
+	assert.Equal(t, ActivityErrorTransient, ActivityErrorCategoryOf(context.DeadlineExceeded), "deadline exceeded")
+	assert.Equal(t, ActivityErrorInvalidInput, ActivityErrorCategoryOf(
+		func() error { _, err := ActivityDescriptionsString("<member"); return err }()), "invalid activity value")
+	assert.Equal(t, ActivityErrorMissingPolicy, ActivityErrorCategoryOf(fmt.Errorf("wrapped: %w", err)),
+		"wrapped error category")
+	assert.Equal(t, ActivityErrorTransient, ActivityErrorCategoryOf(fmt.Errorf("wrapped: %w", context.Canceled)),
+		"wrapped context error category")
+}
+
+func TestActivityErrorExceptionClass(t *testing.T) {
+	classes := map[string]bool{}
+	for _, category := range []ActivityErrorCategory{ActivityErrorTransient, ActivityErrorInvalidInput,
+		ActivityErrorMissingPolicy, ActivityErrorInternal} {
+		classes[category.ExceptionClass()] = true
+	}
+	assert.Len(t, classes, 4, "distinct exception classes")
+	assert.Equal(t, ExceptionClass, ActivityErrorInternal.ExceptionClass(), "internal exception class")
+	assert.True(t, ActivityErrorMissingPolicy.Retryable(), "missing policy retryable")
+	assert.False(t, ActivityErrorInvalidInput.Retryable(), "invalid input not retryable")
+}
+
+func TestActivityErrorCategoryReason(t *testing.T) {
+	assert.Equal(t, "missing-policy: policy not found", ActivityErrorMissingPolicy.Reason("policy not found"),
+		"missing policy reason")
+	assert.Equal(t, "internal: error", ActivityErrorCategoryOf(errors.New("error")).Reason("error"),
+		"uncategorized reason")
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ActivityInput is the decoded input for an activity task
+// Input is a Java style ["class", [args...]] envelope. Arguments are kept as
+// JSON until converted for use.
+type ActivityInput struct {
+	Class     string
+	Arguments []json.RawMessage
+}
+
+// Decode activity task input, nil input has no arguments
+func DecodeActivityInput(input *string) (*ActivityInput, error) {
+	activityInput := &ActivityInput{}
+	if input == nil || len(bytes.TrimSpace([]byte(*input))) == 0 {
+		return activityInput, nil
+	}
+	var envelope []json.RawMessage
+	if err := json.Unmarshal([]byte(*input), &envelope); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid activity input, expected [\"class\", [args...]]: %s", err.Error()))
+	}
+	if len(envelope) != 2 {
+		return nil, errors.New(fmt.Sprintf("invalid activity input, expected 2 envelope elements, found %d", len(envelope)))
+	}
+	if err := json.Unmarshal(envelope[0], &activityInput.Class); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid activity input class: %s", err.Error()))
+	}
+	if isJsonNull(envelope[1]) {
+		return activityInput, nil
+	}
+	if err := json.Unmarshal(envelope[1], &activityInput.Arguments); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid activity input arguments, expected array: %s", err.Error()))
+	}
+	return activityInput, nil
+}
+
+// Get an argument as a string, nil if the argument is missing or null
+// String arguments are unquoted, other arguments are the JSON text.
+func (input *ActivityInput) StringArgument(index int) (*string, error) {
+	if index < 0 || index >= len(input.Arguments) || isJsonNull(input.Arguments[index]) {
+		return nil, nil
+	}
+	argument := input.Arguments[index]
+	if trimmed := bytes.TrimSpace(argument); len(trimmed) > 0 && trimmed[0] == '"' {
+		var value string
+		if err := json.Unmarshal(argument, &value); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid activity argument %d: %s", index, err.Error()))
+		}
+		return &value, nil
+	}
+	value := string(bytes.TrimSpace(argument))
+	return &value, nil
+}
+
+func isJsonNull(value json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(value), []byte("null"))
+}
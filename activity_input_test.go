@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestDecodeActivityInput(t *testing.T) {
+	for _, test := range []struct {
+		input     *string
+		parameter *string
+		signature *string
+	}{
+		{nil, nil, nil},
+		{aws.String(""), nil, nil},
+		{aws.String(`["java.lang.Object[]", null]`), nil, nil},
+		{aws.String(`["java.lang.Object[]", []]`), nil, nil},
+		{aws.String(`["java.lang.Object[]", [null]]`), nil, nil},
+		{aws.String(`["java.lang.Object[]", ["value"]]`), aws.String("value"), nil},
+		{aws.String(`["java.lang.Object[]", ["100%s"]]`), aws.String("100%s"), nil},
+		{aws.String(`["java.lang.Object[]", ["value", "c2ln"]]`), aws.String("value"), aws.String("c2ln")},
+		{aws.String(`["java.lang.Object[]", [42]]`), aws.String("42"), nil},
+		{aws.String(`["java.lang.Object[]", [true]]`), aws.String("true"), nil},
+		{aws.String(`["java.lang.Object[]", [{"a": 1}]]`), aws.String(`{"a": 1}`), nil},
+	} {
+		parameter, activityInput, err := activityTaskArguments(test.input)
+		description := fmt.Sprintf("input %s", value(test.input))
+		assert.NoError(t, err, description)
+		signature, err := activityInput.StringArgument(1)
+		assert.NoError(t, err, description)
+		assert.Equal(t, test.parameter, parameter, description)
+		assert.Equal(t, test.signature, signature, description)
+	}
+}
+
+func TestDecodeActivityInputInvalid(t *testing.T) {
+	for input, message := range map[string]string{
+		`{}`:                        "expected [\"class\", [args...]]",
+		`[]`:                        "found 0",
+		`["java.lang.Object[]"]`:    "found 1",
+		`["a", [], []]`:             "found 3",
+		`[1, []]`:                   "invalid activity input class",
+		`["java.lang.Object[]", 1]`: "expected array",
+		`["java.lang.Object[]", [`:  "expected [\"class\", [args...]]",
+	} {
+		_, err := DecodeActivityInput(&input)
+		if assert.Error(t, err, input) {
+			assert.Contains(t, err.Error(), message, input)
+		}
+	}
+}
+
+// Random JSON values for fuzzing
+func randomJson(random *rand.Rand, depth int) interface{} {
+	switch random.Intn(7) {
+	case 0:
+		return nil
+	case 1:
+		return random.Intn(2) == 0
+	case 2:
+		return random.NormFloat64() * 1000
+	case 3:
+		runes := make([]rune, random.Intn(12))
+		for index := range runes {
+			runes[index] = rune(random.Intn(0x3000))
+		}
+		return string(runes)
+	case 4, 5:
+		if depth > 0 {
+			values := make([]interface{}, random.Intn(4))
+			for index := range values {
+				values[index] = randomJson(random, depth-1)
+			}
+			return values
+		}
+	}
+	if depth > 0 {
+		return map[string]interface{}{"key": randomJson(random, depth-1)}
+	}
+	return "value"
+}
+
+// Decoding arbitrary input must not panic
+func TestDecodeActivityInputFuzz(t *testing.T) {
+	config := &quick.Config{MaxCount: 2000}
+	decode := func(input string) bool {
+		_, _, _ = activityTaskArguments(&input)
+		return true
+	}
+	if err := quick.Check(decode, config); err != nil {
+		t.Error(err)
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for iteration := 0; iteration < 2000; iteration++ {
+		input, err := json.Marshal(randomJson(random, 3))
+		if err != nil {
+			t.Fatalf("Marshal error; %s", err.Error())
+		}
+		inputs := []string{string(input), fmt.Sprintf(`["class", %s]`, input), fmt.Sprintf(`[%s, [%s]]`, input, input)}
+		inputs = append(inputs, inputs[1][:random.Intn(len(inputs[1]))])
+		for _, inputText := range inputs {
+			assert.True(t, decode(inputText), inputText)
+		}
+	}
+}
+
+// Invalid input from the service fails the task rather than the poll
+func TestPollTasksInvalidInput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		_, _ = w.Write([]byte(`{"taskToken":"token","activityId":"1","startedEventId":1,` +
+			`"workflowExecution":{"workflowId":"w","runId":"r"},` +
+			`"activityType":{"name":"LoadBalancingVmActivities.setPolicy","version":"1.0"},` +
+			`"input":"[\"java.lang.Object[]\"]"}`))
+	}))
+	defer server.Close()
+	client := testSwfClient(t, server.URL, SwfClientConfig{PollTimeout: 5 * time.Second})
+	task, err := client.PollTasks(context.Background(), aws.String("domain"), aws.String("task-list"))
+	assert.NoError(t, err, "poll error")
+	if assert.Error(t, task.InputError, "input error") {
+		assert.True(t, strings.HasPrefix(task.InputError.Error(), "invalid activity input"), "input error message")
+	}
+
+	fakeClient := newFakeSwfClient([]*SwfActivityTask{task})
+	assert.NoError(t, pollActivityTask(context.Background(), fakeClient, DefaultLoadBalancer), "poll activity error")
+	assert.Contains(t, fakeClient.failed["token"], "invalid activity input", "failed task message")
+	assert.Equal(t, ActivityErrorInvalidInput, fakeClient.categories["token"], "failed task category")
+}
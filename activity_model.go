@@ -4,7 +4,11 @@
 package main
 
 import (
+	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -63,10 +67,14 @@ type ActivityHealthCheck struct {
 }
 
 type ActivityLoadBalancerAttributes struct {
-	CrossZoneLoadBalancing bool `xml:"CrossZoneLoadBalancing>Enabled"`
-	AccessLog              bool `xml:"AccessLog>Enabled"`
-	ConnectionDraining     bool `xml:"ConnectionDraining>Enabled"`
-	ConnectionSettings     ActivityConnectionSettings
+	CrossZoneLoadBalancing    bool   `xml:"CrossZoneLoadBalancing>Enabled"`
+	AccessLog                 bool   `xml:"AccessLog>Enabled"`
+	AccessLogEmitInterval     int32  `xml:"AccessLog>EmitInterval"`
+	AccessLogS3BucketName     string `xml:"AccessLog>S3BucketName"`
+	AccessLogS3BucketPrefix   string `xml:"AccessLog>S3BucketPrefix"`
+	ConnectionDraining        bool   `xml:"ConnectionDraining>Enabled"`
+	ConnectionDrainingTimeout int32  `xml:"ConnectionDraining>Timeout"`
+	ConnectionSettings        ActivityConnectionSettings
 }
 
 type ActivityConnectionSettings struct {
@@ -84,12 +92,91 @@ type ActivityPolicyAttribute struct {
 	AttributeValue string
 }
 
+// Policy value for a single policy, for output
+type activityPolicyDescriptions struct {
+	XMLName  xml.Name         `xml:"http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/ LoadBalancerDescriptions"`
+	Policies []ActivityPolicy `xml:"member>PolicyDescriptions>member"`
+}
+
 type ActivityTimestamp time.Time
 
+// ActivityInstanceStates is the holder for instance status values
+// An instance status value is the health check result for each backend
+// instance as reported by the servo
+type ActivityInstanceStates struct {
+	InstanceStates []ActivityInstanceState `xml:"member"`
+}
+
+type ActivityInstanceState struct {
+	InstanceId  string
+	State       string
+	ReasonCode  string
+	Description string
+}
+
 // Parse XML descriptions string to ActivityDescriptions
 func ActivityDescriptionsString(descriptions string) (activityDescriptions *ActivityDescriptions, err error) {
 	activityDescriptions = &ActivityDescriptions{}
-	err = xml.Unmarshal([]byte(descriptions), activityDescriptions)
+	err = NewActivityError(ActivityErrorInvalidInput, xml.Unmarshal([]byte(descriptions), activityDescriptions))
+	return
+}
+
+// Parse XML policy descriptions string to the valid policies
+// Policies from all load balancer members are returned. Policies without a
+// name or type are invalid, the error lists invalid policies and is also
+// returned if there are no policies.
+func ActivityPoliciesString(descriptions string) (policies []ActivityPolicy, err error) {
+	activityDescriptions, err := ActivityDescriptionsString(descriptions)
+	if err != nil {
+		return nil, err
+	}
+	var invalid []string
+	for memberIndex, member := range activityDescriptions.LoadBalancers {
+		for policyIndex, policy := range member.PolicyDescriptions {
+			if policy.PolicyName == "" || policy.PolicyTypeName == "" {
+				invalid = append(invalid, fmt.Sprintf("member %d policy %d (name:%s type:%s)",
+					memberIndex+1, policyIndex+1, policy.PolicyName, policy.PolicyTypeName))
+				continue
+			}
+			policies = append(policies, policy)
+		}
+	}
+	if len(invalid) > 0 {
+		err = errors.New(fmt.Sprintf("invalid policies %s", strings.Join(invalid, ", ")))
+	} else if len(policies) == 0 {
+		err = errors.New("no policies")
+	}
+	return policies, NewActivityError(ActivityErrorInvalidInput, err)
+}
+
+// Format a policy as an XML policy descriptions string
+func ActivityPolicyString(policy ActivityPolicy) (string, error) {
+	data, err := xml.Marshal(&activityPolicyDescriptions{Policies: []ActivityPolicy{policy}})
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Split an XML policy descriptions string into values for each valid
+// policy by name
+func ActivityPolicyValues(descriptions string) (map[string]string, error) {
+	policies, err := ActivityPoliciesString(descriptions)
+	values := map[string]string{}
+	for _, policy := range policies {
+		value, marshalErr := ActivityPolicyString(policy)
+		if marshalErr != nil {
+			return nil, marshalErr
+		}
+		values[policy.PolicyName] = value
+	}
+	return values, err
+}
+
+// Parse XML instance status string to ActivityInstanceStates
+func ActivityInstanceStatesString(states string) (activityInstanceStates *ActivityInstanceStates, err error) {
+	activityInstanceStates = &ActivityInstanceStates{}
+	err = xml.Unmarshal([]byte(states), activityInstanceStates)
 	return
 }
 
@@ -97,6 +184,23 @@ func (timestamp ActivityTimestamp) String() string {
 	return time.Time(timestamp).Format(ActivityTimestampLayout)
 }
 
+func (timestamp ActivityTimestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(timestamp.String())
+}
+
+func (timestamp *ActivityTimestamp) UnmarshalJSON(data []byte) (err error) {
+	var text string
+	if err = json.Unmarshal(data, &text); err != nil {
+		return
+	}
+	parse, err := time.Parse(ActivityTimestampLayout, text)
+	if err != nil {
+		return
+	}
+	*timestamp = ActivityTimestamp(parse)
+	return nil
+}
+
 func (timestamp *ActivityTimestamp) UnmarshalXML(d *xml.Decoder, start xml.StartElement) (err error) {
 	var text string
 	err = d.DecodeElement(&text, &start)
@@ -13,6 +13,9 @@ const (
 
 	// Each value is a single policy, but the message uses a list structure
 	ExamplePolicy = `<LoadBalancerDescriptions xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/"><member><PolicyDescriptions><member><PolicyName>sticky</PolicyName><PolicyTypeName>LBCookieStickinessPolicyType</PolicyTypeName><PolicyAttributeDescriptions><member><AttributeName>CookieExpirationPeriod</AttributeName><AttributeValue>300</AttributeValue></member></PolicyAttributeDescriptions></member></PolicyDescriptions></member></LoadBalancerDescriptions>`
+
+	// Multiple policies for multiple load balancers, with an invalid policy
+	ExamplePolicies = `<LoadBalancerDescriptions xmlns="http://elasticloadbalancing.amazonaws.com/doc/2012-06-01/"><member><PolicyDescriptions><member><PolicyName>sticky</PolicyName><PolicyTypeName>LBCookieStickinessPolicyType</PolicyTypeName><PolicyAttributeDescriptions><member><AttributeName>CookieExpirationPeriod</AttributeName><AttributeValue>300</AttributeValue></member></PolicyAttributeDescriptions></member><member><PolicyName>app-sticky</PolicyName><PolicyTypeName>AppCookieStickinessPolicyType</PolicyTypeName><PolicyAttributeDescriptions><member><AttributeName>CookieName</AttributeName><AttributeValue>session</AttributeValue></member></PolicyAttributeDescriptions></member></PolicyDescriptions></member><member><PolicyDescriptions><member><PolicyName>tls</PolicyName><PolicyTypeName>SSLNegotiationPolicyType</PolicyTypeName></member><member><PolicyTypeName>ProxyProtocolPolicyType</PolicyTypeName></member></PolicyDescriptions></member></LoadBalancerDescriptions>`
 )
 
 func TestLoadBalancerRead(t *testing.T) {
@@ -59,3 +62,29 @@ func TestPolicyRead(t *testing.T) {
 		descriptions.LoadBalancers[0].PolicyDescriptions[0].PolicyAttributes[0],
 		"descriptions.LoadBalancers[0].PolicyDescriptions[0].PolicyAttributes[0]")
 }
+
+func TestPoliciesRead(t *testing.T) {
+	policies, err := ActivityPoliciesString(ExamplePolicies)
+	assert.EqualError(t, err, "invalid policies member 2 policy 2 (name: type:ProxyProtocolPolicyType)", "invalid policies")
+	assert.Equal(t, ActivityErrorInvalidInput, ActivityErrorCategoryOf(err), "invalid policies category")
+	if assert.Len(t, policies, 3, "valid policies") {
+		assert.Equal(t, "sticky", policies[0].PolicyName, "policies[0].PolicyName")
+		assert.Equal(t, "app-sticky", policies[1].PolicyName, "policies[1].PolicyName")
+		assert.Equal(t, "tls", policies[2].PolicyName, "policies[2].PolicyName")
+	}
+
+	policies, err = ActivityPoliciesString(ExampleLoadBalancer)
+	assert.EqualError(t, err, "no policies", "load balancer as policy")
+	assert.Len(t, policies, 0, "load balancer policies")
+}
+
+func TestPolicyValues(t *testing.T) {
+	values, err := ActivityPolicyValues(ExamplePolicies)
+	assert.Error(t, err, "invalid policies")
+	assert.Len(t, values, 3, "policy values")
+	descriptions, err := ActivityDescriptionsString(values["sticky"])
+	if assert.NoError(t, err, "ActivityDescriptionsString(values[sticky])") {
+		expected, _ := ActivityDescriptionsString(ExamplePolicy)
+		assert.Equal(t, expected, descriptions, "policy value round trip")
+	}
+}
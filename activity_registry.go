@@ -0,0 +1,334 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// An in activity sends the task parameter to the handler
+	ActivityIn = "in"
+
+	// An out activity sends the default value and receives the result
+	ActivityOut = "out"
+)
+
+// Activities is the registry for the supported workflow activities
+// Registered activity types cannot be changed, activities with changed
+// timeouts or arguments are registered under a new version and the previous
+// version is kept for tasks scheduled with it. Version 1.1 of the signed
+// activities takes the payload signature as the second argument.
+var Activities = NewActivityRegistry(
+	&ActivityDefinition{
+		Name:         "LoadBalancingVmActivities.getCloudWatchMetrics",
+		Channel:      "get-cloudwatch-metrics",
+		Direction:    ActivityOut,
+		DefaultValue: "GetCloudWatchMetrics",
+		DirectResult: MetricsDirectResult,
+	},
+	&ActivityDefinition{
+		Name:                   "LoadBalancingVmActivities.getCloudWatchMetrics",
+		Version:                "1.1",
+		Channel:                "get-cloudwatch-metrics",
+		Direction:              ActivityOut,
+		DefaultValue:           "GetCloudWatchMetrics",
+		DirectResult:           MetricsDirectResult,
+		StartToCloseTimeout:    "30",
+		ScheduleToStartTimeout: "30",
+		ScheduleToCloseTimeout: "60",
+	},
+	&ActivityDefinition{
+		Name:         "LoadBalancingVmActivities.getInstanceStatus",
+		Channel:      "get-instance-status",
+		Direction:    ActivityOut,
+		DefaultValue: "GetInstanceStatus",
+	},
+	&ActivityDefinition{
+		Name:      "LoadBalancingVmActivities.setLoadBalancer",
+		Channel:   "set-loadbalancer",
+		Direction: ActivityIn,
+		Cached:    true,
+		Signed:    true,
+		ValueFile: "loadbalancer",
+	},
+	&ActivityDefinition{
+		Name:                   "LoadBalancingVmActivities.setLoadBalancer",
+		Version:                "1.1",
+		Channel:                "set-loadbalancer",
+		Direction:              ActivityIn,
+		Cached:                 true,
+		Signed:                 true,
+		ValueFile:              "loadbalancer",
+		SignatureArgument:      1,
+		HeartbeatTimeout:       "60",
+		StartToCloseTimeout:    "180",
+		ScheduleToCloseTimeout: "300",
+	},
+	&ActivityDefinition{
+		Name:       "LoadBalancingVmActivities.setPolicy",
+		Channel:    "set-policy",
+		Direction:  ActivityIn,
+		Cached:     true,
+		Signed:     true,
+		ValueFile:  "policy",
+		ValueParts: ActivityPolicyValues,
+	},
+	&ActivityDefinition{
+		Name:              "LoadBalancingVmActivities.setPolicy",
+		Version:           "1.1",
+		Channel:           "set-policy",
+		Direction:         ActivityIn,
+		Cached:            true,
+		Signed:            true,
+		ValueFile:         "policy",
+		ValueParts:        ActivityPolicyValues,
+		SignatureArgument: 1,
+	},
+)
+
+// ActivityDefinition describes a version of a workflow activity and how it
+// is handled
+// Values for cached activities may be sent as the SHA-1 of a previously
+// sent value. The last value for a cached activity is stored to the value
+// file (if any) under the run directory. An activity with value parts
+// also tracks the last value for each named part of a value, stored to the
+// value file with the part name as suffix. Signed activity payloads are
+// subject to signature verification, the signature is sent as an argument
+// for versions with a signature argument. Empty version and timeouts use the
+// registration defaults, an empty heartbeat timeout uses the agent heartbeat
+// timeout. The task list and priority are registered only if set. Cached
+// values are held per load balancer context.
+type ActivityDefinition struct {
+	// Workflow activity name
+	Name    string
+	Version string
+
+	// Handler identifier for the activity
+	Channel string
+
+	// ActivityIn or ActivityOut
+	Direction string
+
+	// Value sent for an activity without a parameter
+	DefaultValue string
+
+	Cached    bool
+	Signed    bool
+	ValueFile string
+
+	// Index of the task input argument with the payload signature, zero if
+	// the version does not send a signature
+	SignatureArgument int
+
+	// Split a value into named parts, such as policies by name
+	ValueParts func(value string) (map[string]string, error)
+
+	// Result for an activity handled by the agent without a handler, such
+	// as metrics published directly. Not handled directly if false.
+	DirectResult func() (string, bool)
+
+	// Registration timeouts in seconds, or NONE
+	HeartbeatTimeout       string
+	StartToCloseTimeout    string
+	ScheduleToStartTimeout string
+	ScheduleToCloseTimeout string
+
+	// Registration default task list and priority
+	TaskList     string
+	TaskPriority string
+}
+
+// ActivityVersionConfig is the configuration for an additional version of a
+// registered activity
+type ActivityVersionConfig struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+
+	// Registration timeouts in seconds, or NONE
+	HeartbeatTimeout       string `json:"heartbeat_timeout"`
+	StartToCloseTimeout    string `json:"start_to_close_timeout"`
+	ScheduleToStartTimeout string `json:"schedule_to_start_timeout"`
+	ScheduleToCloseTimeout string `json:"schedule_to_close_timeout"`
+
+	TaskList     string `json:"task_list"`
+	TaskPriority string `json:"task_priority"`
+}
+
+// The heartbeat timeout for the activity, the given default if the
+// definition has no heartbeat timeout, zero for none
+func (definition *ActivityDefinition) ResolveHeartbeatTimeout(defaultTimeout time.Duration) time.Duration {
+	switch definition.HeartbeatTimeout {
+	case "":
+		return defaultTimeout
+	case "NONE":
+		return 0
+	}
+	timeout, err := strconv.Atoi(definition.HeartbeatTimeout)
+	if err != nil {
+		return defaultTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// ActivityRegistry holds activity definitions by name and version
+// The current version of an activity is the last version registered, tasks
+// for earlier versions continue to be handled.
+type ActivityRegistry struct {
+	mutex       sync.RWMutex
+	definitions map[string][]*ActivityDefinition
+}
+
+func NewActivityRegistry(definitions ...*ActivityDefinition) *ActivityRegistry {
+	registry := &ActivityRegistry{definitions: map[string][]*ActivityDefinition{}}
+	for _, definition := range definitions {
+		if err := registry.Register(definition); err != nil {
+			panic(err)
+		}
+	}
+	return registry
+}
+
+// Register an activity version, defaults are applied for the version and
+// timeouts
+func (registry *ActivityRegistry) Register(definition *ActivityDefinition) error {
+	if definition.Name == "" || definition.Channel == "" {
+		return errors.New("activity definition requires name and channel")
+	}
+	if definition.Direction != ActivityIn && definition.Direction != ActivityOut {
+		return errors.New(fmt.Sprintf("invalid direction %s for activity %s", definition.Direction, definition.Name))
+	}
+	definition.Version = defaultString(definition.Version, ActivityVersion)
+	for _, timeout := range []string{definition.HeartbeatTimeout, definition.StartToCloseTimeout,
+		definition.ScheduleToStartTimeout, definition.ScheduleToCloseTimeout} {
+		if !validTimeout(timeout) {
+			return errors.New(fmt.Sprintf("invalid timeout %s for activity %s %s", timeout, definition.Name, definition.Version))
+		}
+	}
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	versions := registry.definitions[definition.Name]
+	for _, version := range versions {
+		if version.Version == definition.Version {
+			return errors.New(fmt.Sprintf("activity %s %s already registered", definition.Name, definition.Version))
+		}
+		if version.Direction != definition.Direction || version.Cached != definition.Cached {
+			return errors.New(fmt.Sprintf("activity %s %s direction or caching differs from version %s",
+				definition.Name, definition.Version, version.Version))
+		}
+	}
+	definition.StartToCloseTimeout = defaultString(definition.StartToCloseTimeout, DefaultTaskStartToCloseTimeout)
+	definition.ScheduleToStartTimeout = defaultString(definition.ScheduleToStartTimeout, DefaultTaskScheduleToStartTimeout)
+	definition.ScheduleToCloseTimeout = defaultString(definition.ScheduleToCloseTimeout, DefaultTaskScheduleToCloseTimeout)
+	registry.definitions[definition.Name] = append(versions, definition)
+	return nil
+}
+
+// Register a new version of an activity from configuration
+// The version is based on the current version of the activity, the
+// configured timeouts, task list and priority replace those of the current
+// version.
+func (registry *ActivityRegistry) RegisterVersion(config ActivityVersionConfig) error {
+	current, ok := registry.Get(config.Name)
+	if !ok {
+		return errors.New(fmt.Sprintf("activity %s not registered", config.Name))
+	}
+	if config.Version == "" {
+		return errors.New(fmt.Sprintf("activity %s version required", config.Name))
+	}
+	definition := *current
+	definition.Version = config.Version
+	definition.HeartbeatTimeout = defaultString(config.HeartbeatTimeout, current.HeartbeatTimeout)
+	definition.StartToCloseTimeout = defaultString(config.StartToCloseTimeout, current.StartToCloseTimeout)
+	definition.ScheduleToStartTimeout = defaultString(config.ScheduleToStartTimeout, current.ScheduleToStartTimeout)
+	definition.ScheduleToCloseTimeout = defaultString(config.ScheduleToCloseTimeout, current.ScheduleToCloseTimeout)
+	definition.TaskList = defaultString(config.TaskList, current.TaskList)
+	definition.TaskPriority = defaultString(config.TaskPriority, current.TaskPriority)
+	return registry.Register(&definition)
+}
+
+// Register activity versions from a JSON configuration file
+// The file is a list of activity versions, versions are registered in order.
+func (registry *ActivityRegistry) RegisterVersionsFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var configs []ActivityVersionConfig
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return errors.New(fmt.Sprintf("invalid activity versions file %s: %s", path, err.Error()))
+	}
+	for _, config := range configs {
+		if err = registry.RegisterVersion(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the current version of an activity by name
+func (registry *ActivityRegistry) Get(name string) (*ActivityDefinition, bool) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	versions := registry.definitions[name]
+	if len(versions) == 0 {
+		return nil, false
+	}
+	return versions[len(versions)-1], true
+}
+
+// Get an activity by name and version, the current version if the version
+// is empty
+func (registry *ActivityRegistry) Lookup(name string, version string) (*ActivityDefinition, bool) {
+	if version == "" {
+		return registry.Get(name)
+	}
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	for _, definition := range registry.definitions[name] {
+		if definition.Version == version {
+			return definition, true
+		}
+	}
+	return nil, false
+}
+
+// Get all activity definitions ordered by name, then registration
+func (registry *ActivityRegistry) Definitions() []*ActivityDefinition {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+	names := make([]string, 0, len(registry.definitions))
+	for name := range registry.definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var definitions []*ActivityDefinition
+	for _, name := range names {
+		definitions = append(definitions, registry.definitions[name]...)
+	}
+	return definitions
+}
+
+// Registration timeouts are seconds or NONE, empty for the default
+func validTimeout(timeout string) bool {
+	if timeout == "" || timeout == "NONE" {
+		return true
+	}
+	seconds, err := strconv.Atoi(timeout)
+	return err == nil && seconds >= 0
+}
+
+func defaultString(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestActivityRegistry(t *testing.T) {
+	registry := NewActivityRegistry(&ActivityDefinition{
+		Name:      "Activities.setValue",
+		Channel:   "set-value",
+		Direction: ActivityIn,
+		Cached:    true,
+	})
+	definition, ok := registry.Get("Activities.setValue")
+	if assert.True(t, ok, "registered activity") {
+		assert.Equal(t, ActivityVersion, definition.Version, "default version")
+		assert.Equal(t, "", definition.HeartbeatTimeout, "default heartbeat timeout")
+		assert.Equal(t, DefaultTaskScheduleToCloseTimeout, definition.ScheduleToCloseTimeout, "default schedule to close timeout")
+	}
+	_, ok = registry.Get("Activities.getValue")
+	assert.False(t, ok, "unregistered activity")
+
+	assert.Error(t, registry.Register(&ActivityDefinition{
+		Name: "Activities.setValue", Channel: "set-value", Direction: ActivityIn, Cached: true,
+	}), "duplicate activity version")
+	assert.Error(t, registry.Register(&ActivityDefinition{
+		Name: "Activities.setValue", Channel: "set-value", Direction: ActivityOut, Version: "2.0",
+	}), "activity version with different direction")
+	assert.Error(t, registry.Register(&ActivityDefinition{
+		Name: "Activities.getValue", Channel: "get-value",
+	}), "activity without direction")
+	assert.Error(t, registry.Register(&ActivityDefinition{
+		Name: "Activities.getValue", Channel: "get-value", Direction: ActivityOut, StartToCloseTimeout: "1m",
+	}), "activity with invalid timeout")
+	assert.NoError(t, registry.Register(&ActivityDefinition{
+		Name: "Activities.getValue", Channel: "get-value", Direction: ActivityOut, Version: "2.0",
+	}), "register activity")
+	definitions := registry.Definitions()
+	if assert.Len(t, definitions, 2, "definitions") {
+		assert.Equal(t, "Activities.getValue", definitions[0].Name, "definitions order")
+		assert.Equal(t, "2.0", definitions[0].Version, "version")
+	}
+}
+
+func TestActivityRegistryVersions(t *testing.T) {
+	registry := NewActivityRegistry(
+		&ActivityDefinition{
+			Name: "Activities.setValue", Channel: "set-value", Direction: ActivityIn, Cached: true,
+		},
+		&ActivityDefinition{
+			Name: "Activities.setValue", Channel: "set-value-v2", Direction: ActivityIn, Cached: true,
+			Version: "2.0", StartToCloseTimeout: "300", TaskList: "values", TaskPriority: "5",
+		},
+	)
+	current, ok := registry.Get("Activities.setValue")
+	if assert.True(t, ok, "current version") {
+		assert.Equal(t, "2.0", current.Version, "current version")
+		assert.Equal(t, "300", current.StartToCloseTimeout, "version timeout")
+	}
+	previous, ok := registry.Lookup("Activities.setValue", "1.0")
+	if assert.True(t, ok, "previous version") {
+		assert.Equal(t, "set-value", previous.Channel, "previous version channel")
+		assert.Equal(t, DefaultTaskStartToCloseTimeout, previous.StartToCloseTimeout, "previous version timeout")
+	}
+	unversioned, _ := registry.Lookup("Activities.setValue", "")
+	assert.Equal(t, current, unversioned, "lookup without version")
+	_, ok = registry.Lookup("Activities.setValue", "3.0")
+	assert.False(t, ok, "unregistered version")
+	assert.Len(t, registry.Definitions(), 2, "definitions for all versions")
+}
+
+// Additional versions are registered from configuration based on the
+// current version
+func TestActivityRegistryVersionsFile(t *testing.T) {
+	registry := NewActivityRegistry(&ActivityDefinition{
+		Name: "Activities.setValue", Channel: "set-value", Direction: ActivityIn, Cached: true,
+		StartToCloseTimeout: "60", HeartbeatTimeout: "30",
+	})
+	versionsFile, err := ioutil.TempFile("", "versions")
+	if err != nil {
+		t.Fatalf("TempFile error; %s", err.Error())
+	}
+	defer os.Remove(versionsFile.Name())
+	_, _ = versionsFile.WriteString(`[
+  {"name": "Activities.setValue", "version": "2.0", "start_to_close_timeout": "300", "task_list": "values"}
+]`)
+	_ = versionsFile.Close()
+	assert.NoError(t, registry.RegisterVersionsFile(versionsFile.Name()), "register versions file")
+	current, ok := registry.Get("Activities.setValue")
+	if assert.True(t, ok, "current version") {
+		assert.Equal(t, "2.0", current.Version, "current version")
+		assert.Equal(t, "set-value", current.Channel, "current version channel")
+		assert.True(t, current.Cached, "current version cached")
+		assert.Equal(t, "300", current.StartToCloseTimeout, "configured timeout")
+		assert.Equal(t, "30", current.HeartbeatTimeout, "inherited timeout")
+		assert.Equal(t, "values", current.TaskList, "configured task list")
+	}
+	previous, _ := registry.Lookup("Activities.setValue", ActivityVersion)
+	assert.Equal(t, "60", previous.StartToCloseTimeout, "previous version timeout")
+
+	assert.Error(t, registry.RegisterVersion(ActivityVersionConfig{Name: "Activities.getValue", Version: "2.0"}),
+		"version of unregistered activity")
+	assert.Error(t, registry.RegisterVersion(ActivityVersionConfig{Name: "Activities.setValue"}),
+		"version required")
+	assert.Error(t, registry.RegisterVersion(ActivityVersionConfig{Name: "Activities.setValue", Version: "2.0"}),
+		"duplicate version")
+}
+
+// A new activity is handled with a single registration, tasks are handled
+// for each registered version
+func TestActivityRegistration(t *testing.T) {
+	savedActivities, savedFactory := Activities, ActivityHandlerFactory
+	defer func() { Activities, ActivityHandlerFactory = savedActivities, savedFactory }()
+	Activities = NewActivityRegistry(
+		&ActivityDefinition{
+			Name:         "LoadBalancingVmActivities.getExample",
+			Channel:      "get-example",
+			Direction:    ActivityOut,
+			DefaultValue: "GetExample",
+		},
+		&ActivityDefinition{
+			Name:         "LoadBalancingVmActivities.getExample",
+			Version:      "2.0",
+			Channel:      "get-example-v2",
+			Direction:    ActivityOut,
+			DefaultValue: "GetExample",
+		},
+	)
+	ActivityHandlerFactory = func() (ActivityHandler, error) {
+		return &fakeActivityHandler{}, nil
+	}
+	versionedTask := func(token string, name string, version string) *SwfActivityTask {
+		task := activityTask(token, name, nil)
+		task.Version = &version
+		return task
+	}
+	client := newFakeSwfClient([]*SwfActivityTask{
+		versionedTask("v1", "LoadBalancingVmActivities.getExample", "1.0"),
+		versionedTask("v2", "LoadBalancingVmActivities.getExample", "2.0"),
+		versionedTask("v3", "LoadBalancingVmActivities.getExample", "3.0"),
+		versionedTask("status", "LoadBalancingVmActivities.getInstanceStatus", "1.0"),
+	})
+	for client.remaining() > 0 {
+		assert.NoError(t, pollActivityTask(context.Background(), client, DefaultLoadBalancer), "poll error")
+	}
+	assert.Equal(t, "result-get-example", value(client.completed["v1"]), "version 1.0 result")
+	assert.Equal(t, "result-get-example-v2", value(client.completed["v2"]), "version 2.0 result")
+	assert.Contains(t, client.failed["v3"], "unknown activity", "unregistered version")
+	assert.Contains(t, client.failed["status"], "unknown activity", "unregistered activity")
+}
+
+// Changed timeouts are registered under a new version, the previous version
+// keeps the registration defaults
+func TestActivitiesVersions(t *testing.T) {
+	for _, name := range []string{"LoadBalancingVmActivities.getCloudWatchMetrics", "LoadBalancingVmActivities.setLoadBalancer"} {
+		previous, ok := Activities.Lookup(name, ActivityVersion)
+		if assert.True(t, ok, "previous version for "+name) {
+			assert.Equal(t, DefaultTaskStartToCloseTimeout, previous.StartToCloseTimeout, "previous timeout for "+name)
+			assert.Equal(t, DefaultTaskScheduleToCloseTimeout, previous.ScheduleToCloseTimeout, "previous timeout for "+name)
+		}
+		current, ok := Activities.Get(name)
+		if assert.True(t, ok, "current version for "+name) {
+			assert.Equal(t, "1.1", current.Version, "current version for "+name)
+		}
+	}
+	metrics, _ := Activities.Get("LoadBalancingVmActivities.getCloudWatchMetrics")
+	assert.Equal(t, "30", metrics.StartToCloseTimeout, "metrics timeout")
+	loadBalancer, _ := Activities.Get("LoadBalancingVmActivities.setLoadBalancer")
+	assert.Equal(t, "60", loadBalancer.HeartbeatTimeout, "load balancer heartbeat timeout")
+	assert.Equal(t, "300", loadBalancer.ScheduleToCloseTimeout, "load balancer timeout")
+}
@@ -0,0 +1,428 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Agent check response for an instance that should receive traffic
+	AgentCheckUp = "up"
+
+	// Agent check response for an instance that should not receive traffic
+	AgentCheckDown = "down"
+
+	// Agent check response for an instance that should only receive
+	// traffic for existing (sticky) sessions
+	AgentCheckDrain = "drain"
+
+	// Instance state reported for a healthy instance
+	InstanceStateInService = "InService"
+
+	// Time to wait for the agent-send string from HAProxy
+	AgentCheckReadTimeout = 2 * time.Second
+
+	// Time to wait for the agent-check response to be sent
+	AgentCheckWriteTimeout = 2 * time.Second
+
+	// Minimum interval between checks of the overrides file
+	AgentCheckOverridesInterval = 5 * time.Second
+
+	// Drain time when connection draining does not specify a timeout
+	DefaultConnectionDrainingTimeout = 300 * time.Second
+)
+
+// InstanceHealth is the agents view of backend instance health
+var InstanceHealth = NewAgentHealthState()
+
+// AgentCheckServers are the agent-check responders by backend name
+var AgentCheckServers = NewAgentCheckServerGroup()
+
+// AgentHealthState tracks the health of backend instances
+type AgentHealthState struct {
+	mutex     sync.RWMutex
+	Instances map[string]*AgentInstanceState
+	Overrides map[string]string
+}
+
+// AgentInstanceState is the agents view of a single backend instance
+type AgentInstanceState struct {
+	InstanceId        string
+	InstanceIpAddress string
+	Healthy           bool
+	Draining          bool
+	DrainUntil        time.Time
+}
+
+// AgentCheckServer is a TCP agent-check responder for a backend
+type AgentCheckServer struct {
+	Backend  string
+	Port     int
+	State    *AgentHealthState
+	Listener net.Listener
+}
+
+// AgentCheckServerGroup manages an agent-check responder per backend
+// Responders use ports from the base port, a backend keeps its port while
+// it is configured and new backends use the lowest free port. The number of
+// responders is limited to the maximum ports if set.
+type AgentCheckServerGroup struct {
+	mutex          sync.Mutex
+	overridesMutex sync.Mutex
+	BasePort       int
+	MaxPorts       int
+	OverridesPath  string
+	Servers        map[string]*AgentCheckServer
+	overridesTime  time.Time
+	overridesCheck time.Time
+}
+
+// ActivityHandler implementation that maintains agent health state
+// Load balancer values update the set of backend instances and agent-check
+// responders, instance status results update instance health.
+type AgentCheckHandler struct {
+	State   *AgentHealthState
+	Servers *AgentCheckServerGroup
+}
+
+func NewAgentHealthState() *AgentHealthState {
+	return &AgentHealthState{
+		Instances: map[string]*AgentInstanceState{},
+		Overrides: map[string]string{},
+	}
+}
+
+// Update the backend instances for the load balancer
+// Instances that are no longer present are drained when connection
+// draining is enabled, otherwise they are removed immediately.
+func (state *AgentHealthState) UpdateInstances(instances []ActivityBackendInstance, draining bool, drainTimeout time.Duration, timeNow time.Time) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	current := map[string]bool{}
+	for _, instance := range instances {
+		current[instance.InstanceId] = true
+		if instanceState, ok := state.Instances[instance.InstanceId]; ok {
+			instanceState.InstanceIpAddress = instance.InstanceIpAddress
+			instanceState.Draining = false
+		} else {
+			state.Instances[instance.InstanceId] = &AgentInstanceState{
+				InstanceId:        instance.InstanceId,
+				InstanceIpAddress: instance.InstanceIpAddress,
+				Healthy:           true,
+			}
+		}
+	}
+	for instanceId, instanceState := range state.Instances {
+		if current[instanceId] {
+			continue
+		}
+		if draining && !instanceState.Draining {
+			instanceState.Draining = true
+			instanceState.DrainUntil = timeNow.Add(drainTimeout)
+		} else if !draining || timeNow.After(instanceState.DrainUntil) {
+			delete(state.Instances, instanceId)
+		}
+	}
+}
+
+// Update instance health from health check results
+func (state *AgentHealthState) UpdateHealth(instanceStates []ActivityInstanceState) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	for _, instanceStatus := range instanceStates {
+		if instanceState, ok := state.Instances[instanceStatus.InstanceId]; ok {
+			instanceState.Healthy = instanceStatus.State == InstanceStateInService
+		}
+	}
+}
+
+// Set the administrative overrides by instance identifier
+func (state *AgentHealthState) SetOverrides(overrides map[string]string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.Overrides = overrides
+}
+
+// Get a copy of the current instance states ordered by instance identifier
+func (state *AgentHealthState) InstanceStates() []AgentInstanceState {
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	instanceStates := make([]AgentInstanceState, 0, len(state.Instances))
+	for _, instanceState := range state.Instances {
+		instanceStates = append(instanceStates, *instanceState)
+	}
+	sort.Slice(instanceStates, func(i, j int) bool {
+		return instanceStates[i].InstanceId < instanceStates[j].InstanceId
+	})
+	return instanceStates
+}
+
+// Get the agent-check response for an instance
+// An administrative override takes precedence, followed by connection
+// draining and then instance health. Weights are set using overrides.
+func (state *AgentHealthState) AgentStatus(instanceId string) string {
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+	if override, ok := state.Overrides[instanceId]; ok {
+		return override
+	}
+	if instanceId == "" {
+		return AgentCheckUp
+	}
+	instanceState, ok := state.Instances[instanceId]
+	switch {
+	case !ok:
+		return AgentCheckDown
+	case instanceState.Draining:
+		return AgentCheckDrain
+	case !instanceState.Healthy:
+		return AgentCheckDown
+	}
+	return AgentCheckUp
+}
+
+// Parse administrative overrides text
+// Each line is an instance identifier followed by the agent-check response
+// to use for the instance, e.g. "i-00000001 drain" or "i-00000001 50%".
+func AgentCheckOverridesString(overridesText string) (map[string]string, error) {
+	overrides := map[string]string{}
+	for lineNumber, line := range strings.Split(overridesText, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, errors.New(fmt.Sprintf("invalid override at line %d: %s", lineNumber+1, line))
+		}
+		overrides[fields[0]] = strings.Join(fields[1:], " ")
+	}
+	return overrides, nil
+}
+
+func NewAgentCheckServerGroup() *AgentCheckServerGroup {
+	return &AgentCheckServerGroup{Servers: map[string]*AgentCheckServer{}}
+}
+
+// Get the agent-check port for a backend, zero if there is no responder
+func (group *AgentCheckServerGroup) Port(backend string) int {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if server, ok := group.Servers[backend]; ok {
+		return server.Port
+	}
+	return 0
+}
+
+// Configure responders for the given backends
+// Responders are started for new backends and stopped for backends that
+// are no longer present. Responders are not used when there is no base port.
+func (group *AgentCheckServerGroup) Configure(state *AgentHealthState, backends []string) error {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if group.BasePort <= 0 {
+		return nil
+	}
+	if group.MaxPorts > 0 && len(backends) > group.MaxPorts {
+		return errors.New(fmt.Sprintf("Agent-check ports from %d exhausted, %d backends for %d ports",
+			group.BasePort, len(backends), group.MaxPorts))
+	}
+	configured := map[string]bool{}
+	for _, backend := range backends {
+		configured[backend] = true
+	}
+	usedPorts := map[int]bool{}
+	for backend, server := range group.Servers {
+		if configured[backend] {
+			usedPorts[server.Port] = true
+			continue
+		}
+		server.Close()
+		delete(group.Servers, backend)
+	}
+	sort.Strings(backends)
+	port := group.BasePort
+	for _, backend := range backends {
+		if _, ok := group.Servers[backend]; ok {
+			continue
+		}
+		for usedPorts[port] {
+			port++
+		}
+		server, err := NewAgentCheckServer(backend, port, state)
+		if err != nil {
+			return err
+		}
+		usedPorts[port] = true
+		group.Servers[backend] = server
+		go server.Serve(group.refreshOverrides)
+	}
+	return nil
+}
+
+// Stop all responders
+func (group *AgentCheckServerGroup) Close() {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	for backend, server := range group.Servers {
+		server.Close()
+		delete(group.Servers, backend)
+	}
+}
+
+// Reload administrative overrides if the overrides file has changed
+// The file is checked at most once per overrides interval.
+func (group *AgentCheckServerGroup) refreshOverrides(state *AgentHealthState) {
+	group.overridesMutex.Lock()
+	defer group.overridesMutex.Unlock()
+	if group.OverridesPath == "" {
+		return
+	}
+	timeNow := time.Now()
+	if !group.overridesCheck.IsZero() && timeNow.Sub(group.overridesCheck) < AgentCheckOverridesInterval {
+		return
+	}
+	group.overridesCheck = timeNow
+	overridesInfo, err := os.Stat(group.OverridesPath)
+	if err != nil {
+		if !group.overridesTime.IsZero() {
+			group.overridesTime = time.Time{}
+			state.SetOverrides(map[string]string{})
+		}
+		return
+	}
+	if overridesInfo.ModTime().Equal(group.overridesTime) {
+		return
+	}
+	data, err := ioutil.ReadFile(group.OverridesPath)
+	if err != nil {
+		logger.Printf("Error reading agent check overrides %s\n", err.Error())
+		return
+	}
+	overrides, err := AgentCheckOverridesString(string(data))
+	if err != nil {
+		logger.Printf("Error parsing agent check overrides %s\n", err.Error())
+		return
+	}
+	group.overridesTime = overridesInfo.ModTime()
+	state.SetOverrides(overrides)
+}
+
+// Create an agent-check responder listening on the given port
+func NewAgentCheckServer(backend string, port int, state *AgentHealthState) (*AgentCheckServer, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error listening for agent check %s on port %d: %s",
+			backend, port, err.Error()))
+	}
+	return &AgentCheckServer{backend, port, state, listener}, nil
+}
+
+// Accept and respond to agent checks until the server is closed
+func (server *AgentCheckServer) Serve(beforeCheck func(*AgentHealthState)) {
+	for {
+		conn, err := server.Listener.Accept()
+		if err != nil {
+			return
+		}
+		if beforeCheck != nil {
+			beforeCheck(server.State)
+		}
+		go server.respond(conn)
+	}
+}
+
+// Respond to an agent check with the status for the instance identifier
+// sent by HAProxy (agent-send), the identifier is newline terminated. An
+// identifier that is not terminated is used when the read times out.
+func (server *AgentCheckServer) respond(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(AgentCheckReadTimeout))
+	instanceId, _ := bufio.NewReader(conn).ReadString('\n')
+	_ = conn.SetWriteDeadline(time.Now().Add(AgentCheckWriteTimeout))
+	_, err := conn.Write([]byte(server.State.AgentStatus(strings.TrimSpace(instanceId)) + "\n"))
+	if err != nil {
+		logger.Printf("Error responding to agent check for %s %s\n", server.Backend, err.Error())
+	}
+}
+
+func (server *AgentCheckServer) Close() {
+	_ = server.Listener.Close()
+}
+
+// Create an ActivityHandler that maintains agent health state
+func NewAgentCheckHandler(state *AgentHealthState, servers *AgentCheckServerGroup) ActivityHandler {
+	return &AgentCheckHandler{state, servers}
+}
+
+func (handler *AgentCheckHandler) Send(name string, value string) error {
+	switch name {
+	case "set-loadbalancer":
+		return handler.HandleLoadBalancer(value)
+	}
+	return nil
+}
+
+func (handler *AgentCheckHandler) Receive(_ string) (*string, error) {
+	return nil, errors.New("not supported")
+}
+
+func (handler *AgentCheckHandler) Received(name string, value string) {
+	switch name {
+	case "get-instance-status":
+		instanceStates, err := ActivityInstanceStatesString(value)
+		if err != nil {
+			logger.Printf("Error parsing instance status %s\n", err.Error())
+			return
+		}
+		handler.State.UpdateHealth(instanceStates.InstanceStates)
+	}
+}
+
+func (handler *AgentCheckHandler) Close() {
+}
+
+func (handler *AgentCheckHandler) HandleLoadBalancer(loadBalancer string) error {
+	activityDescriptions, err := ActivityDescriptionsString(loadBalancer)
+	if err != nil || len(activityDescriptions.LoadBalancers) != 1 {
+		return err
+	}
+	return handler.ConfigureLoadBalancer(activityDescriptions.LoadBalancers[0])
+}
+
+// Update backend instances and agent-check responders for a load balancer
+func (handler *AgentCheckHandler) ConfigureLoadBalancer(activityLoadBalancer ActivityLoadBalancer) error {
+	attributes := activityLoadBalancer.LoadBalancerAttributes
+	drainTimeout := DefaultConnectionDrainingTimeout
+	if attributes.ConnectionDrainingTimeout > 0 {
+		drainTimeout = seconds(int64(attributes.ConnectionDrainingTimeout))
+	}
+	handler.State.UpdateInstances(activityLoadBalancer.BackendInstances,
+		attributes.ConnectionDraining, drainTimeout, time.Now())
+	var backends []string
+	for _, listener := range activityLoadBalancer.Listeners {
+		backends = append(backends, BackendName(listener))
+	}
+	return handler.Servers.Configure(handler.State, backends)
+}
+
+// The HAProxy backend name for a listener
+func BackendName(listener ActivityLoadBalancerListener) string {
+	protocol := listener.InstanceProtocol
+	if protocol == "" {
+		protocol = listener.Protocol
+	}
+	return fmt.Sprintf("backend-%s-%d", strings.ToLower(protocol), listener.LoadBalancerPort)
+}
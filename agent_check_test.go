@@ -0,0 +1,138 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const ExampleInstanceStatus = `<InstanceStates><member><InstanceId>i-00000001</InstanceId><State>InService</State></member><member><InstanceId>i-00000002</InstanceId><State>OutOfService</State><ReasonCode>Instance</ReasonCode></member></InstanceStates>`
+
+func exampleBackendInstances() []ActivityBackendInstance {
+	return []ActivityBackendInstance{
+		{InstanceId: "i-00000001", InstanceIpAddress: "10.111.10.215"},
+		{InstanceId: "i-00000002", InstanceIpAddress: "10.111.10.216"},
+	}
+}
+
+func TestAgentStatus(t *testing.T) {
+	state := NewAgentHealthState()
+	state.UpdateInstances(exampleBackendInstances(), false, 0, time.Now())
+	assert.Equal(t, AgentCheckUp, state.AgentStatus("i-00000001"), "AgentStatus(i-00000001)")
+	assert.Equal(t, AgentCheckUp, state.AgentStatus("i-00000002"), "AgentStatus(i-00000002)")
+	assert.Equal(t, AgentCheckDown, state.AgentStatus("i-00000003"), "AgentStatus(i-00000003)")
+
+	instanceStates, err := ActivityInstanceStatesString(ExampleInstanceStatus)
+	if err != nil {
+		t.Fatalf("ActivityInstanceStatesString(ExampleInstanceStatus) error; %s", err.Error())
+	}
+	state.UpdateHealth(instanceStates.InstanceStates)
+	assert.Equal(t, AgentCheckUp, state.AgentStatus("i-00000001"), "AgentStatus(i-00000001)")
+	assert.Equal(t, AgentCheckDown, state.AgentStatus("i-00000002"), "AgentStatus(i-00000002)")
+
+	state.SetOverrides(map[string]string{"i-00000002": "up 50%"})
+	assert.Equal(t, "up 50%", state.AgentStatus("i-00000002"), "AgentStatus(i-00000002) with override")
+}
+
+func TestAgentHealthDraining(t *testing.T) {
+	state := NewAgentHealthState()
+	timeNow := time.Now()
+	state.UpdateInstances(exampleBackendInstances(), true, time.Minute, timeNow)
+	state.UpdateInstances(exampleBackendInstances()[:1], true, time.Minute, timeNow)
+	assert.Equal(t, AgentCheckDrain, state.AgentStatus("i-00000002"), "AgentStatus(i-00000002) draining")
+	assert.Equal(t, 2, len(state.InstanceStates()), "len(InstanceStates()) draining")
+
+	state.UpdateInstances(exampleBackendInstances()[:1], true, time.Minute, timeNow.Add(2*time.Minute))
+	assert.Equal(t, AgentCheckDown, state.AgentStatus("i-00000002"), "AgentStatus(i-00000002) drained")
+	assert.Equal(t, 1, len(state.InstanceStates()), "len(InstanceStates()) drained")
+
+	state.UpdateInstances(exampleBackendInstances()[1:], false, time.Minute, timeNow)
+	assert.Equal(t, AgentCheckDown, state.AgentStatus("i-00000001"), "AgentStatus(i-00000001) not draining")
+}
+
+func TestAgentCheckOverrides(t *testing.T) {
+	overrides, err := AgentCheckOverridesString("# overrides\ni-00000001 drain\n\ni-00000002 up 75%\n")
+	if err != nil {
+		t.Fatalf("AgentCheckOverridesString error; %s", err.Error())
+	}
+	assert.Equal(t, map[string]string{"i-00000001": "drain", "i-00000002": "up 75%"}, overrides, "overrides")
+
+	_, err = AgentCheckOverridesString("i-00000001")
+	assert.Error(t, err, "AgentCheckOverridesString(i-00000001)")
+}
+
+func TestAgentCheckServer(t *testing.T) {
+	state := NewAgentHealthState()
+	state.UpdateInstances(exampleBackendInstances(), false, 0, time.Now())
+	state.SetOverrides(map[string]string{"i-00000002": AgentCheckDrain})
+	server, err := NewAgentCheckServer("backend-http-8080", 0, state)
+	if err != nil {
+		t.Fatalf("NewAgentCheckServer error; %s", err.Error())
+	}
+	defer server.Close()
+	go server.Serve(nil)
+
+	// send the configured agent-send string as HAProxy would
+	check := func(instanceId string) string {
+		agentSendValue, err := strconv.Unquote(agentSend(instanceId))
+		if err != nil {
+			t.Fatalf("Unquote(agentSend) error; %s", err.Error())
+		}
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial error; %s", err.Error())
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(AgentCheckReadTimeout / 2))
+		_, err = conn.Write([]byte(agentSendValue))
+		if err != nil {
+			t.Fatalf("Write error; %s", err.Error())
+		}
+		response, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read error; %s", err.Error())
+		}
+		return response
+	}
+	assert.Equal(t, "up\n", check("i-00000001"), "agent check i-00000001")
+	assert.Equal(t, "drain\n", check("i-00000002"), "agent check i-00000002")
+	assert.Equal(t, "down\n", check("i-00000003"), "agent check i-00000003")
+}
+
+// Backends keep their agent-check ports when other backends change
+func TestAgentCheckServerGroupPorts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen error; %s", err.Error())
+	}
+	basePort := listener.Addr().(*net.TCPAddr).Port
+	_ = listener.Close()
+	group := NewAgentCheckServerGroup()
+	group.BasePort, group.MaxPorts = basePort, 3
+	defer group.Close()
+	state := NewAgentHealthState()
+	ports := func() map[string]int {
+		ports := map[string]int{}
+		for _, backend := range []string{"backend-http-80", "backend-http-81", "backend-http-82", "backend-http-83"} {
+			if port := group.Port(backend); port > 0 {
+				ports[backend] = port - basePort
+			}
+		}
+		return ports
+	}
+	if !assert.NoError(t, group.Configure(state, []string{"backend-http-81", "backend-http-82"}), "configure") {
+		return
+	}
+	assert.Equal(t, map[string]int{"backend-http-81": 0, "backend-http-82": 1}, ports(), "initial ports")
+	assert.NoError(t, group.Configure(state, []string{"backend-http-80", "backend-http-81", "backend-http-82"}), "add backend")
+	assert.Equal(t, map[string]int{"backend-http-80": 2, "backend-http-81": 0, "backend-http-82": 1}, ports(), "ports after add")
+	assert.NoError(t, group.Configure(state, []string{"backend-http-80", "backend-http-82"}), "remove backend")
+	assert.NoError(t, group.Configure(state, []string{"backend-http-80", "backend-http-82", "backend-http-83"}), "reuse port")
+	assert.Equal(t, map[string]int{"backend-http-80": 2, "backend-http-82": 1, "backend-http-83": 0}, ports(), "ports after reuse")
+}
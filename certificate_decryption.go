@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ServerCertificateDecryption decrypts server certificate material for
+// the servo instance
+var ServerCertificateDecryption = &CertificateDecryption{}
+
+// CertificateDecryption decrypts data encrypted with the public key of the
+// servo instance certificate
+// The instance private key is replaced when the servo credentials change.
+type CertificateDecryption struct {
+	mutex sync.RWMutex
+	key   *rsa.PrivateKey
+}
+
+// Use the instance private key from the given credentials, credentials
+// listener for the credentials watcher
+func (decryption *CertificateDecryption) SetCredentials(_ Credentials, values *CredentialValues) {
+	decryption.mutex.Lock()
+	defer decryption.mutex.Unlock()
+	decryption.key = values.InstancePrivateKey
+}
+
+// Decrypt data encrypted (RSA PKCS #1 v1.5) with the instance public key
+func (decryption *CertificateDecryption) Decrypt(encrypted []byte) ([]byte, error) {
+	decryption.mutex.RLock()
+	key := decryption.key
+	decryption.mutex.RUnlock()
+	if key == nil {
+		return nil, errors.New("no instance private key for certificate decryption")
+	}
+	decrypted, err := rsa.DecryptPKCS1v15(rand.Reader, key, encrypted)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("certificate decryption failed: %s", err.Error()))
+	}
+	return decrypted, nil
+}
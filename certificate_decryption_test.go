@@ -0,0 +1,34 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// Decryption uses the instance key from the latest credentials
+func TestCertificateDecryption(t *testing.T) {
+	decryption := &CertificateDecryption{}
+	_, err := decryption.Decrypt([]byte("encrypted"))
+	assert.Error(t, err, "decrypt without credentials")
+
+	first := generateTestCertificate(t, "i-00000001", nil)
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, &first.key.PublicKey, []byte("certificate key"))
+	if err != nil {
+		t.Fatalf("EncryptPKCS1v15 error; %s", err.Error())
+	}
+	decryption.SetCredentials(Credentials{}, &CredentialValues{InstancePrivateKey: first.key})
+	decrypted, err := decryption.Decrypt(encrypted)
+	if assert.NoError(t, err, "decrypt with instance key") {
+		assert.Equal(t, "certificate key", string(decrypted), "decrypted value")
+	}
+
+	second := generateTestCertificate(t, "i-00000001", nil)
+	decryption.SetCredentials(Credentials{}, &CredentialValues{InstancePrivateKey: second.key})
+	_, err = decryption.Decrypt(encrypted)
+	assert.Error(t, err, "decrypt with replaced instance key")
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"sync"
+)
+
+// CloudTLSTrust is the TLS trust for cloud service endpoints
+var CloudTLSTrust = &CloudTrust{}
+
+// CloudTrust holds the TLS configuration for connections to cloud endpoints
+// The configuration can be replaced while clients are in use, the
+// generation changes with each replacement. System roots are trusted when
+// there is no configuration.
+type CloudTrust struct {
+	mutex      sync.RWMutex
+	config     *tls.Config
+	generation int
+}
+
+// Create a TLS configuration that trusts the given Eucalyptus certificate
+// When pinned only the Eucalyptus certificate is trusted, otherwise it is
+// trusted in addition to the system roots.
+func NewCloudTLSConfig(eucalyptusCertificate *x509.Certificate, pinned bool) *tls.Config {
+	var pool *x509.CertPool
+	if !pinned {
+		if systemPool, err := x509.SystemCertPool(); err == nil {
+			pool = systemPool
+		}
+	}
+	if pool == nil {
+		pool = x509.NewCertPool()
+	}
+	pool.AddCert(eucalyptusCertificate)
+	return &tls.Config{RootCAs: pool}
+}
+
+// Set the TLS configuration for new connections
+func (trust *CloudTrust) Set(config *tls.Config) {
+	trust.mutex.Lock()
+	defer trust.mutex.Unlock()
+	trust.config = config
+	trust.generation++
+}
+
+// Get a copy of the TLS configuration for a new connection
+func (trust *CloudTrust) Config() *tls.Config {
+	config, _ := trust.current()
+	return config
+}
+
+func (trust *CloudTrust) current() (*tls.Config, int) {
+	trust.mutex.RLock()
+	defer trust.mutex.RUnlock()
+	if trust.config == nil {
+		return &tls.Config{}, trust.generation
+	}
+	return trust.config.Clone(), trust.generation
+}
+
+// Create an HTTP transport that uses the current trust
+// The transport is created by the given function with the TLS client
+// configuration for the trust, and is created again when the trust changes
+// so connections made with the previous trust are not reused.
+func (trust *CloudTrust) Transport(newTransport func(*tls.Config) *http.Transport) http.RoundTripper {
+	return &cloudTransport{trust: trust, newTransport: newTransport, generation: -1}
+}
+
+// HTTP transport for the current cloud trust
+type cloudTransport struct {
+	mutex        sync.Mutex
+	trust        *CloudTrust
+	newTransport func(*tls.Config) *http.Transport
+	transport    *http.Transport
+	generation   int
+}
+
+func (transport *cloudTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return transport.current().RoundTrip(request)
+}
+
+func (transport *cloudTransport) CloseIdleConnections() {
+	transport.current().CloseIdleConnections()
+}
+
+func (transport *cloudTransport) current() *http.Transport {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	config, generation := transport.trust.current()
+	if transport.transport == nil || transport.generation != generation {
+		if transport.transport != nil {
+			transport.transport.CloseIdleConnections()
+		}
+		transport.transport = transport.newTransport(config)
+		transport.generation = generation
+	}
+	return transport.transport
+}
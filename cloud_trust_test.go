@@ -0,0 +1,169 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Generated certificate and key for tests
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *rsa.PrivateKey
+}
+
+// Generate a certificate, self-signed if there is no issuer
+func generateTestCertificate(t *testing.T, name string, issuer *testCertificate) *testCertificate {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey error; %s", err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	parent, parentKey := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		parent, parentKey = issuer.certificate, issuer.key
+	}
+	certificateDer, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate error; %s", err.Error())
+	}
+	certificate, err := x509.ParseCertificate(certificateDer)
+	if err != nil {
+		t.Fatalf("ParseCertificate error; %s", err.Error())
+	}
+	return &testCertificate{certificate, key}
+}
+
+// Start a TLS server with a certificate issued by the given CA
+func startTestTLSServer(t *testing.T, ca *testCertificate) *httptest.Server {
+	serverCertificate := generateTestCertificate(t, "127.0.0.1", ca)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{serverCertificate.certificate.Raw},
+		PrivateKey:  serverCertificate.key,
+	}}}
+	server.StartTLS()
+	return server
+}
+
+func TestCloudTrust(t *testing.T) {
+	savedConfig := CloudTLSTrust.Config()
+	defer CloudTLSTrust.Set(savedConfig)
+	cloudCA := generateTestCertificate(t, "eucalyptus", nil)
+	otherCA := generateTestCertificate(t, "other", nil)
+	server := startTestTLSServer(t, cloudCA)
+	defer server.Close()
+
+	get := func() error {
+		response, err := NewHttpClient(5*time.Second, 1, 5*time.Second).Get(server.URL)
+		if err == nil {
+			_ = response.Body.Close()
+		}
+		return err
+	}
+
+	CloudTLSTrust.Set(nil)
+	assert.Error(t, get(), "request using system roots")
+
+	CloudTLSTrust.Set(NewCloudTLSConfig(cloudCA.certificate, false))
+	assert.NoError(t, get(), "request trusting Eucalyptus CA")
+
+	CloudTLSTrust.Set(NewCloudTLSConfig(cloudCA.certificate, true))
+	assert.NoError(t, get(), "request pinned to Eucalyptus CA")
+
+	CloudTLSTrust.Set(NewCloudTLSConfig(otherCA.certificate, true))
+	assert.Error(t, get(), "request pinned to other CA")
+}
+
+// Trust changes apply to clients in use, including requests via a proxy
+func TestCloudTrustProxy(t *testing.T) {
+	savedConfig, savedProxy := CloudTLSTrust.Config(), HttpProxy
+	defer func() { CloudTLSTrust.Set(savedConfig); HttpProxy = savedProxy }()
+	cloudCA := generateTestCertificate(t, "eucalyptus", nil)
+	otherCA := generateTestCertificate(t, "other", nil)
+	server := startTestTLSServer(t, cloudCA)
+	defer server.Close()
+
+	var tunnels int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&tunnels, 1)
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+		go func() { _, _ = io.Copy(target, conn); _ = target.Close() }()
+		go func() { _, _ = io.Copy(conn, target); _ = conn.Close() }()
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	HttpProxy = http.ProxyURL(proxyURL)
+
+	client := NewHttpClient(5*time.Second, 1, 5*time.Second)
+	get := func() error {
+		response, err := client.Get(server.URL)
+		if err == nil {
+			_ = response.Body.Close()
+		}
+		return err
+	}
+	CloudTLSTrust.Set(NewCloudTLSConfig(cloudCA.certificate, true))
+	assert.NoError(t, get(), "request via proxy pinned to Eucalyptus CA")
+	CloudTLSTrust.Set(NewCloudTLSConfig(otherCA.certificate, true))
+	assert.Error(t, get(), "request via proxy pinned to other CA")
+	CloudTLSTrust.Set(nil)
+	assert.Error(t, get(), "request via proxy using system roots")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&tunnels), "requests via proxy")
+}
+
+func TestCredentialsEucalyptusCertificate(t *testing.T) {
+	credentials, err := CredentialString(ExampleCredentials)
+	if err != nil {
+		t.Fatalf("CredentialString error; %s", err.Error())
+	}
+	certificate, err := credentials.EucalyptusCertificate()
+	if assert.NoError(t, err, "certificate decode error") {
+		assert.Equal(t, "eucalyptus", certificate.Subject.CommonName, "certificate subject")
+	}
+	credentials.EucalyptusPublicKey = "invalid"
+	_, err = credentials.EucalyptusCertificate()
+	assert.Error(t, err, "invalid certificate decode")
+}
@@ -0,0 +1,329 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Namespace for load balancer metrics
+	MetricsNamespace = "AWS/ELB"
+
+	// Maximum metric datums for a PutMetricData request
+	MetricsMaxDatumsPerRequest = 20
+
+	// Interval for publishing metrics
+	MetricsPublishInterval = 60 * time.Second
+
+	// Attempts for publishing a batch of metrics
+	MetricsPublishAttempts = 3
+
+	// Initial delay before retrying a failed metrics publish
+	MetricsPublishBackoff = 2 * time.Second
+)
+
+// Metrics is the metrics collector for the load balancer
+var Metrics = NewMetricsCollector()
+
+// MetricsPublishedDirectly is set when the agent publishes metrics
+var MetricsPublishedDirectly = false
+
+// MetricsCollector aggregates load balancer metrics from HAProxy log records
+type MetricsCollector struct {
+	mutex            sync.Mutex
+	LoadBalancerName string
+	AvailabilityZone string
+	counts           map[string]float64
+	latency          *cloudwatch.StatisticSet
+}
+
+// CloudWatchPublisher publishes collected metrics with PutMetricData
+type CloudWatchPublisher struct {
+	Client    cloudwatchiface.CloudWatchAPI
+	Collector *MetricsCollector
+	Health    *AgentHealthState
+	Attempts  int
+	Backoff   time.Duration
+}
+
+// ActivityHandler implementation that configures metrics dimensions
+type MetricsHandler struct {
+	Collector *MetricsCollector
+}
+
+func NewMetricsCollector() *MetricsCollector {
+	return &MetricsCollector{counts: map[string]float64{}}
+}
+
+// Configure the load balancer dimension for collected metrics
+// The availability zone dimension is the zone of the servo instance, set
+// from instance metadata.
+func (collector *MetricsCollector) Configure(loadBalancerName string) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.LoadBalancerName = loadBalancerName
+}
+
+// Record metrics for an HAProxy log record
+func (collector *MetricsCollector) Record(record *HaproxyLogRecord) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.counts["RequestCount"]++
+	if !record.HasServer() {
+		if record.StatusCode >= 500 {
+			collector.counts["HTTPCode_ELB_5XX"]++
+			if record.ConnectTime < 0 {
+				collector.counts["BackendConnectionErrors"]++
+			}
+		} else if record.StatusCode >= 400 {
+			collector.counts["HTTPCode_ELB_4XX"]++
+		}
+		return
+	}
+	if record.StatusCode >= 200 && record.StatusCode < 600 {
+		collector.counts[fmt.Sprintf("HTTPCode_Backend_%dXX", record.StatusCode/100)]++
+	}
+	if record.ResponseTime >= 0 {
+		latency := float64(record.ResponseTime) / 1000
+		if collector.latency == nil {
+			collector.latency = &cloudwatch.StatisticSet{
+				Maximum:     aws.Float64(latency),
+				Minimum:     aws.Float64(latency),
+				SampleCount: aws.Float64(0),
+				Sum:         aws.Float64(0),
+			}
+		}
+		if latency > *collector.latency.Maximum {
+			collector.latency.Maximum = aws.Float64(latency)
+		}
+		if latency < *collector.latency.Minimum {
+			collector.latency.Minimum = aws.Float64(latency)
+		}
+		collector.latency.SampleCount = aws.Float64(*collector.latency.SampleCount + 1)
+		collector.latency.Sum = aws.Float64(*collector.latency.Sum + latency)
+	}
+}
+
+// Merge unpublished metric datums back into the collector
+// Merged values are included in the next datums. Host counts are current
+// values when datums are created so are not merged.
+func (collector *MetricsCollector) Merge(datums []*cloudwatch.MetricDatum) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	for _, datum := range datums {
+		if datum == nil || datum.MetricName == nil {
+			continue
+		}
+		name := *datum.MetricName
+		switch {
+		case name == "HealthyHostCount" || name == "UnHealthyHostCount":
+		case datum.StatisticValues != nil:
+			collector.mergeLatency(datum.StatisticValues)
+		case datum.Value != nil:
+			collector.counts[name] += *datum.Value
+		}
+	}
+}
+
+func (collector *MetricsCollector) mergeLatency(latency *cloudwatch.StatisticSet) {
+	if collector.latency == nil {
+		collector.latency = &cloudwatch.StatisticSet{
+			Maximum:     aws.Float64(*latency.Maximum),
+			Minimum:     aws.Float64(*latency.Minimum),
+			SampleCount: aws.Float64(*latency.SampleCount),
+			Sum:         aws.Float64(*latency.Sum),
+		}
+		return
+	}
+	if *latency.Maximum > *collector.latency.Maximum {
+		collector.latency.Maximum = aws.Float64(*latency.Maximum)
+	}
+	if *latency.Minimum < *collector.latency.Minimum {
+		collector.latency.Minimum = aws.Float64(*latency.Minimum)
+	}
+	collector.latency.SampleCount = aws.Float64(*collector.latency.SampleCount + *latency.SampleCount)
+	collector.latency.Sum = aws.Float64(*collector.latency.Sum + *latency.Sum)
+}
+
+// Get metric datums for the collected metrics and reset the collector
+// Metrics collected without a load balancer name are discarded. Host counts
+// are included when health state is given. Datums that are not
+// published should be merged back into the collector.
+func (collector *MetricsCollector) Datums(timestamp time.Time, health *AgentHealthState) []*cloudwatch.MetricDatum {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	if collector.LoadBalancerName == "" {
+		collector.counts = map[string]float64{}
+		collector.latency = nil
+		return nil
+	}
+	dimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("LoadBalancerName"), Value: aws.String(collector.LoadBalancerName)},
+	}
+	if collector.AvailabilityZone != "" {
+		dimensions = append(dimensions,
+			&cloudwatch.Dimension{Name: aws.String("AvailabilityZone"), Value: aws.String(collector.AvailabilityZone)})
+	}
+	datum := func(name string, unit string) *cloudwatch.MetricDatum {
+		return &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(timestamp),
+			Unit:       aws.String(unit),
+		}
+	}
+	var datums []*cloudwatch.MetricDatum
+	var names []string
+	for name := range collector.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		countDatum := datum(name, cloudwatch.StandardUnitCount)
+		countDatum.Value = aws.Float64(collector.counts[name])
+		datums = append(datums, countDatum)
+	}
+	if collector.latency != nil {
+		latencyDatum := datum("Latency", cloudwatch.StandardUnitSeconds)
+		latencyDatum.StatisticValues = collector.latency
+		datums = append(datums, latencyDatum)
+	}
+	if health != nil {
+		healthy, unhealthy := 0, 0
+		for _, instanceState := range health.InstanceStates() {
+			if instanceState.Draining {
+				continue
+			}
+			if instanceState.Healthy {
+				healthy++
+			} else {
+				unhealthy++
+			}
+		}
+		healthyDatum := datum("HealthyHostCount", cloudwatch.StandardUnitCount)
+		healthyDatum.Value = aws.Float64(float64(healthy))
+		unhealthyDatum := datum("UnHealthyHostCount", cloudwatch.StandardUnitCount)
+		unhealthyDatum.Value = aws.Float64(float64(unhealthy))
+		datums = append(datums, healthyDatum, unhealthyDatum)
+	}
+	collector.counts = map[string]float64{}
+	collector.latency = nil
+	return datums
+}
+
+// Create a CloudWatch client for the given endpoint and region.
+func NewCloudWatchClient(endpoint string, region string) (cloudwatchiface.CloudWatchAPI, error) {
+	sess, err := NewAwsSession(endpoint, region)
+	if err != nil {
+		return nil, err
+	}
+	return cloudwatch.New(sess), nil
+}
+
+// Create a publisher for metrics from the given collector
+func NewCloudWatchPublisher(client cloudwatchiface.CloudWatchAPI, collector *MetricsCollector, health *AgentHealthState) *CloudWatchPublisher {
+	return &CloudWatchPublisher{
+		Client:    client,
+		Collector: collector,
+		Health:    health,
+		Attempts:  MetricsPublishAttempts,
+		Backoff:   MetricsPublishBackoff,
+	}
+}
+
+// Publish collected metrics at each interval
+func (publisher *CloudWatchPublisher) Run() {
+	for timeNow := range time.Tick(MetricsPublishInterval) {
+		err := publisher.Publish(publisher.Collector.Datums(timeNow, publisher.Health))
+		if err != nil {
+			logger.Printf("Error publishing metrics %s\n", err.Error())
+		}
+	}
+}
+
+// Publish metric datums in batches within the PutMetricData limits
+// Datums that could not be published are merged back into the collector.
+func (publisher *CloudWatchPublisher) Publish(datums []*cloudwatch.MetricDatum) error {
+	for start := 0; start < len(datums); start += MetricsMaxDatumsPerRequest {
+		end := start + MetricsMaxDatumsPerRequest
+		if end > len(datums) {
+			end = len(datums)
+		}
+		err := publisher.publishBatch(datums[start:end])
+		if err != nil {
+			if publisher.Collector != nil {
+				publisher.Collector.Merge(datums[start:])
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (publisher *CloudWatchPublisher) publishBatch(datums []*cloudwatch.MetricDatum) (err error) {
+	backoff := publisher.Backoff
+	for attempt := 1; attempt <= publisher.Attempts; attempt++ {
+		_, err = publisher.Client.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(MetricsNamespace),
+			MetricData: datums,
+		})
+		if err == nil {
+			return nil
+		}
+		if attempt < publisher.Attempts {
+			logger.Printf("Error publishing metrics (attempt %d) %s\n", attempt, err.Error())
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return errors.New(fmt.Sprintf("Error publishing %d metrics after %d attempts: %s",
+		len(datums), publisher.Attempts, err.Error()))
+}
+
+// Direct result for the metrics activity
+// Metrics published by the agent are not returned to the workflow.
+func MetricsDirectResult() (string, bool) {
+	if !MetricsPublishedDirectly {
+		return "", false
+	}
+	logger.Println("Metrics are published directly, returning empty metrics")
+	return "", true
+}
+
+// Create an ActivityHandler that configures metrics dimensions
+func NewMetricsHandler(collector *MetricsCollector) ActivityHandler {
+	return &MetricsHandler{collector}
+}
+
+func (handler *MetricsHandler) Send(name string, value string) error {
+	switch name {
+	case "set-loadbalancer":
+		return handler.HandleLoadBalancer(value)
+	}
+	return nil
+}
+
+func (handler *MetricsHandler) Receive(_ string) (*string, error) {
+	return nil, errors.New("not supported")
+}
+
+func (handler *MetricsHandler) Close() {
+}
+
+func (handler *MetricsHandler) HandleLoadBalancer(loadBalancer string) error {
+	activityDescriptions, err := ActivityDescriptionsString(loadBalancer)
+	if err != nil || len(activityDescriptions.LoadBalancers) != 1 {
+		return err
+	}
+	handler.Collector.Configure(activityDescriptions.LoadBalancers[0].LoadBalancerName)
+	return nil
+}
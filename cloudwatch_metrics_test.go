@@ -0,0 +1,114 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// CloudWatch client that records published metric data
+type fakeCloudWatchClient struct {
+	cloudwatchiface.CloudWatchAPI
+	failures int
+	requests []*cloudwatch.PutMetricDataInput
+}
+
+func (client *fakeCloudWatchClient) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	if client.failures > 0 {
+		client.failures--
+		return nil, errors.New("unavailable")
+	}
+	client.requests = append(client.requests, input)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestMetricsCollector(t *testing.T) {
+	collector := NewMetricsCollector()
+	unconfiguredRecord, err := HaproxyLogRecordString(ExampleHaproxyLogRecord)
+	if err != nil {
+		t.Fatalf("HaproxyLogRecordString error; %s", err.Error())
+	}
+	collector.Record(unconfiguredRecord)
+	assert.Equal(t, 0, len(collector.Datums(time.Now(), nil)), "len(Datums()) unconfigured")
+
+	collector.AvailabilityZone = "one"
+	collector.Configure("balancer-1")
+	for _, line := range []string{ExampleHaproxyLogRecord, ExampleHaproxyLogRecord, ExampleHaproxyLogRecordNoServer} {
+		record, err := HaproxyLogRecordString(line)
+		if err != nil {
+			t.Fatalf("HaproxyLogRecordString error; %s", err.Error())
+		}
+		collector.Record(record)
+	}
+	health := NewAgentHealthState()
+	health.UpdateInstances(exampleBackendInstances(), false, 0, time.Now())
+	datums := map[string]*cloudwatch.MetricDatum{}
+	for _, datum := range collector.Datums(time.Now(), health) {
+		datums[*datum.MetricName] = datum
+		assert.Equal(t, 2, len(datum.Dimensions), "len(datum.Dimensions)")
+	}
+	assert.Equal(t, 3.0, *datums["RequestCount"].Value, "RequestCount")
+	assert.Equal(t, 2.0, *datums["HTTPCode_Backend_2XX"].Value, "HTTPCode_Backend_2XX")
+	assert.Equal(t, 1.0, *datums["HTTPCode_ELB_5XX"].Value, "HTTPCode_ELB_5XX")
+	assert.Equal(t, 2.0, *datums["Latency"].StatisticValues.SampleCount, "Latency.SampleCount")
+	assert.Equal(t, 0.005, *datums["Latency"].StatisticValues.Maximum, "Latency.Maximum")
+	assert.Equal(t, 2.0, *datums["HealthyHostCount"].Value, "HealthyHostCount")
+
+	datums = map[string]*cloudwatch.MetricDatum{}
+	for _, datum := range collector.Datums(time.Now(), nil) {
+		datums[*datum.MetricName] = datum
+	}
+	assert.Equal(t, 0, len(datums), "len(Datums()) after reset")
+}
+
+func TestCloudWatchPublish(t *testing.T) {
+	client := &fakeCloudWatchClient{failures: 1}
+	publisher := NewCloudWatchPublisher(client, NewMetricsCollector(), nil)
+	publisher.Backoff = time.Millisecond
+	datums := make([]*cloudwatch.MetricDatum, 45)
+	err := publisher.Publish(datums)
+	if err != nil {
+		t.Fatalf("Publish error; %s", err.Error())
+	}
+	if assert.Equal(t, 3, len(client.requests), "PutMetricData requests") {
+		assert.Equal(t, MetricsMaxDatumsPerRequest, len(client.requests[0].MetricData), "len(requests[0].MetricData)")
+		assert.Equal(t, 5, len(client.requests[2].MetricData), "len(requests[2].MetricData)")
+		assert.Equal(t, MetricsNamespace, *client.requests[0].Namespace, "requests[0].Namespace")
+	}
+
+	client.failures = MetricsPublishAttempts
+	assert.Error(t, publisher.Publish(datums), "Publish with failing client")
+}
+
+// Metrics that are not published are included in the next publish
+func TestCloudWatchPublishFailureMerge(t *testing.T) {
+	collector := NewMetricsCollector()
+	collector.Configure("balancer-1")
+	record, err := HaproxyLogRecordString(ExampleHaproxyLogRecord)
+	if err != nil {
+		t.Fatalf("HaproxyLogRecordString error; %s", err.Error())
+	}
+	collector.Record(record)
+	client := &fakeCloudWatchClient{failures: MetricsPublishAttempts}
+	publisher := NewCloudWatchPublisher(client, collector, NewAgentHealthState())
+	publisher.Backoff = time.Millisecond
+	assert.Error(t, publisher.Publish(collector.Datums(time.Now(), publisher.Health)), "Publish with failing client")
+	collector.Record(record)
+	datums := map[string]*cloudwatch.MetricDatum{}
+	for _, datum := range collector.Datums(time.Now(), publisher.Health) {
+		datums[*datum.MetricName] = datum
+	}
+	if assert.Contains(t, datums, "RequestCount", "RequestCount after failure") {
+		assert.Equal(t, 2.0, *datums["RequestCount"].Value, "RequestCount after failure")
+	}
+	if assert.Contains(t, datums, "Latency", "Latency after failure") {
+		assert.Equal(t, 2.0, *datums["Latency"].StatisticValues.SampleCount, "Latency.SampleCount after failure")
+	}
+	assert.Equal(t, 0.0, *datums["HealthyHostCount"].Value, "HealthyHostCount after failure")
+}
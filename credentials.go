@@ -4,9 +4,16 @@
 package main
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
-	"os"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"strings"
+	"time"
 )
 
 type Credentials struct {
@@ -35,17 +42,11 @@ func CredentialString(credentialsText string) (credentials Credentials, err erro
 }
 
 func CredentialFile(credentialsPath string) (credentials Credentials, err error) {
-	credentialsFile, err := os.Open(credentialsPath)
+	credentialsData, err := ioutil.ReadFile(credentialsPath)
 	if err != nil {
 		return
 	}
-	defer credentialsFile.Close()
-	credentialsData := make([]byte, 1024*32)
-	dataLength, err := credentialsFile.Read(credentialsData)
-	if err != nil {
-		return
-	}
-	credentials, err = CredentialString(string(credentialsData[:dataLength]))
+	credentials, err = CredentialString(string(credentialsData))
 	return
 }
 
@@ -58,3 +59,164 @@ func (credentials *Credentials) Clean() {
 		credentials.EucalyptusPublicKey = strings.TrimSpace(credentials.EucalyptusPublicKey)
 	}
 }
+
+// CredentialValues are the decoded values for Credentials, values are
+// nil when not present
+type CredentialValues struct {
+	InstanceCertificate   *x509.Certificate
+	InstancePrivateKey    *rsa.PrivateKey
+	IamCertificate        *x509.Certificate
+	IamToken              []byte
+	EucalyptusCertificate *x509.Certificate
+}
+
+// CredentialsError is an error for a credentials field
+type CredentialsError struct {
+	// JSON name of the field
+	Field string
+
+	Err error
+}
+
+func (err *CredentialsError) Error() string {
+	return fmt.Sprintf("credentials %s: %s", err.Field, err.Err.Error())
+}
+
+// Decode the clouds certificate
+func (credentials *Credentials) EucalyptusCertificate() (*x509.Certificate, error) {
+	certificate, err := decodeCertificate(credentials.EucalyptusPublicKey)
+	if err != nil {
+		return nil, &CredentialsError{"euca_pub_key", err}
+	}
+	return certificate, nil
+}
+
+// Decode all present credentials values
+// The instance certificate and private key must match if both are present.
+// Errors are of type *CredentialsError.
+func (credentials *Credentials) Decode() (values *CredentialValues, err error) {
+	values = &CredentialValues{}
+	if credentials.InstancePublicKey != "" {
+		if values.InstanceCertificate, err = decodeCertificate(credentials.InstancePublicKey); err != nil {
+			return nil, &CredentialsError{"instance_pub_key", err}
+		}
+	}
+	if credentials.InstancePrivateKey != "" {
+		if values.InstancePrivateKey, err = decodePrivateKey(credentials.InstancePrivateKey); err != nil {
+			return nil, &CredentialsError{"instance_pk", err}
+		}
+	}
+	if credentials.IamPublicKey != "" {
+		if values.IamCertificate, err = decodeCertificate(credentials.IamPublicKey); err != nil {
+			return nil, &CredentialsError{"iam_pub_key", err}
+		}
+	}
+	if credentials.IamToken != "" {
+		if values.IamToken, err = base64.StdEncoding.DecodeString(credentials.IamToken); err != nil {
+			return nil, &CredentialsError{"iam_token", errors.New(fmt.Sprintf("invalid token encoding: %s", err.Error()))}
+		}
+	}
+	if credentials.EucalyptusPublicKey != "" {
+		if values.EucalyptusCertificate, err = credentials.EucalyptusCertificate(); err != nil {
+			return nil, err
+		}
+	}
+	if values.InstanceCertificate != nil && values.InstancePrivateKey != nil {
+		publicKey, ok := values.InstanceCertificate.PublicKey.(*rsa.PublicKey)
+		if !ok || publicKey.N.Cmp(values.InstancePrivateKey.N) != 0 || publicKey.E != values.InstancePrivateKey.E {
+			return nil, &CredentialsError{"instance_pk", errors.New("private key does not match instance certificate")}
+		}
+	}
+	return values, nil
+}
+
+// Check that the certificates are valid at the given time
+// Errors are of type *CredentialsError.
+func (values *CredentialValues) Validate(timeNow time.Time) error {
+	for _, field := range values.certificateFields() {
+		if timeNow.Before(field.certificate.NotBefore) {
+			return &CredentialsError{field.name, errors.New(fmt.Sprintf("certificate not valid until %s",
+				field.certificate.NotBefore.UTC().Format(time.RFC3339)))}
+		}
+		if timeNow.After(field.certificate.NotAfter) {
+			return &CredentialsError{field.name, errors.New(fmt.Sprintf("certificate expired at %s",
+				field.certificate.NotAfter.UTC().Format(time.RFC3339)))}
+		}
+	}
+	return nil
+}
+
+// Get the earliest certificate expiry, zero if there are no certificates
+func (values *CredentialValues) Expiry() (expiry time.Time) {
+	for _, field := range values.certificateFields() {
+		if expiry.IsZero() || field.certificate.NotAfter.Before(expiry) {
+			expiry = field.certificate.NotAfter
+		}
+	}
+	return
+}
+
+type credentialsCertificate struct {
+	name        string
+	certificate *x509.Certificate
+}
+
+func (values *CredentialValues) certificateFields() []credentialsCertificate {
+	var fields []credentialsCertificate
+	for _, field := range []credentialsCertificate{
+		{"instance_pub_key", values.InstanceCertificate},
+		{"iam_pub_key", values.IamCertificate},
+		{"euca_pub_key", values.EucalyptusCertificate},
+	} {
+		if field.certificate != nil {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Decode a base-64 encoded PEM X.509 certificate
+func decodeCertificate(encodedCertificate string) (*x509.Certificate, error) {
+	block, err := decodePem(encodedCertificate, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Decode a base-64 encoded PEM RSA private key in PKCS #1 or PKCS #8 form
+func decodePrivateKey(encodedKey string) (*rsa.PrivateKey, error) {
+	block, err := decodePem(encodedKey, "RSA PRIVATE KEY", "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func decodePem(encodedPem string, blockTypes ...string) (*pem.Block, error) {
+	pemData, err := base64.StdEncoding.DecodeString(encodedPem)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid base-64 encoding: %s", err.Error()))
+	}
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	for _, blockType := range blockTypes {
+		if block.Type == blockType {
+			return block, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("unexpected PEM type %s", block.Type))
+}
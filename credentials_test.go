@@ -4,8 +4,13 @@
 package main
 
 import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 const ExampleCredentials = `{
@@ -38,3 +43,69 @@ func TestCredentialsRead(t *testing.T) {
 		}
 	}
 }
+
+func TestCredentialsDecode(t *testing.T) {
+	credentials, err := CredentialString(ExampleCredentials)
+	if err != nil {
+		t.Fatalf("CredentialString error; %s", err.Error())
+	}
+	values, err := credentials.Decode()
+	if err != nil {
+		t.Fatalf("Decode error; %s", err.Error())
+	}
+	assert.NotNil(t, values.InstanceCertificate, "instance certificate")
+	assert.NotNil(t, values.InstancePrivateKey, "instance private key")
+	assert.NotNil(t, values.IamCertificate, "iam certificate")
+	assert.NotEmpty(t, values.IamToken, "iam token")
+	assert.NotNil(t, values.EucalyptusCertificate, "eucalyptus certificate")
+	assert.Equal(t, values.InstanceCertificate.NotAfter, values.Expiry(), "earliest expiry")
+	assert.NoError(t, values.Validate(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)), "validate while valid")
+	err = values.Validate(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	if assert.IsType(t, &CredentialsError{}, err, "validate after expiry") {
+		assert.Equal(t, "instance_pub_key", err.(*CredentialsError).Field, "expired field")
+	}
+}
+
+func TestCredentialsDecodeKeyMismatch(t *testing.T) {
+	credentials, err := CredentialString(ExampleCredentials)
+	if err != nil {
+		t.Fatalf("CredentialString error; %s", err.Error())
+	}
+	credentials.InstancePublicKey = credentials.IamPublicKey
+	_, err = credentials.Decode()
+	if assert.IsType(t, &CredentialsError{}, err, "decode mismatched key") {
+		assert.Equal(t, "instance_pk", err.(*CredentialsError).Field, "mismatched field")
+	}
+}
+
+func TestCredentialsDecodeInvalid(t *testing.T) {
+	for field, credentials := range map[string]Credentials{
+		"instance_pub_key": {InstancePublicKey: "invalid"},
+		"instance_pk":      {InstancePrivateKey: base64.StdEncoding.EncodeToString([]byte("not pem"))},
+		"iam_pub_key":      {IamPublicKey: "LS0tLS1"},
+		"iam_token":        {IamToken: "%%%"},
+		"euca_pub_key":     {EucalyptusPublicKey: "invalid"},
+	} {
+		_, err := credentials.Decode()
+		if assert.IsType(t, &CredentialsError{}, err, "decode invalid "+field) {
+			assert.Equal(t, field, err.(*CredentialsError).Field, "invalid field")
+		}
+	}
+}
+
+// Credentials larger than a single read are not truncated
+func TestCredentialFileLarge(t *testing.T) {
+	credentialsFile, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatalf("TempFile error; %s", err.Error())
+	}
+	defer os.Remove(credentialsFile.Name())
+	padding := strings.Repeat(" ", 64*1024)
+	_, _ = credentialsFile.WriteString(strings.Replace(ExampleCredentials, "\n", padding+"\n", -1))
+	_ = credentialsFile.Close()
+	credentials, err := CredentialFile(credentialsFile.Name())
+	if assert.NoError(t, err, "read error") {
+		_, err = credentials.Decode()
+		assert.NoError(t, err, "decode error")
+	}
+}
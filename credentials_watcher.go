@@ -0,0 +1,130 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Interval for checking the credentials file for changes
+const CredentialsWatchInterval = 30 * time.Second
+
+// ServoCredentials is the watcher for the servo credentials file, nil if
+// there is no credentials file
+var ServoCredentials *CredentialsWatcher
+
+// CredentialsWatcher loads the credentials file when it changes
+// New credentials are decoded and validated before replacing the current
+// credentials, invalid credentials are logged and ignored. A file is
+// checked again until it is valid, as validity can depend on the time.
+// Listeners are notified of each replacement.
+type CredentialsWatcher struct {
+	mutex       sync.Mutex
+	notifyMutex sync.Mutex
+	Path        string
+	Interval    time.Duration
+	credentials Credentials
+	values      *CredentialValues
+	generation  int
+	modTime     time.Time
+	size        int64
+	listeners   []func(Credentials, *CredentialValues)
+}
+
+func NewCredentialsWatcher(path string) *CredentialsWatcher {
+	return &CredentialsWatcher{Path: path, Interval: CredentialsWatchInterval}
+}
+
+// Add a listener for new credentials
+// The listener is called immediately if credentials are loaded.
+func (watcher *CredentialsWatcher) AddListener(listener func(Credentials, *CredentialValues)) {
+	watcher.notifyMutex.Lock()
+	defer watcher.notifyMutex.Unlock()
+	watcher.mutex.Lock()
+	watcher.listeners = append(watcher.listeners, listener)
+	credentials, values, generation := watcher.credentials, watcher.values, watcher.generation
+	watcher.mutex.Unlock()
+	if generation > 0 {
+		listener(credentials, values)
+	}
+}
+
+// Get the current credentials and generation, the generation is zero if
+// no valid credentials have been loaded
+func (watcher *CredentialsWatcher) Current() (Credentials, *CredentialValues, int) {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	return watcher.credentials, watcher.values, watcher.generation
+}
+
+// Load the credentials file if it has changed
+// Returns true if the current credentials were replaced.
+func (watcher *CredentialsWatcher) Check(timeNow time.Time) (bool, error) {
+	watcher.notifyMutex.Lock()
+	defer watcher.notifyMutex.Unlock()
+	watcher.mutex.Lock()
+	info, err := os.Stat(watcher.Path)
+	if err != nil {
+		watcher.mutex.Unlock()
+		return false, err
+	}
+	if info.ModTime().Equal(watcher.modTime) && info.Size() == watcher.size {
+		watcher.mutex.Unlock()
+		return false, nil
+	}
+	credentials, values, err := loadCredentials(watcher.Path, timeNow)
+	if err != nil {
+		loaded := watcher.generation > 0
+		watcher.mutex.Unlock()
+		if loaded {
+			return false, errors.New(fmt.Sprintf("keeping current credentials, %s", err.Error()))
+		}
+		return false, err
+	}
+	watcher.modTime = info.ModTime()
+	watcher.size = info.Size()
+	watcher.credentials = credentials
+	watcher.values = values
+	watcher.generation++
+	listeners := watcher.listeners
+	watcher.mutex.Unlock()
+	for _, listener := range listeners {
+		listener(credentials, values)
+	}
+	return true, nil
+}
+
+// Check for credentials changes at each interval
+func (watcher *CredentialsWatcher) Run() {
+	ticker := time.NewTicker(watcher.Interval)
+	defer ticker.Stop()
+	for timeNow := range ticker.C {
+		changed, err := watcher.Check(timeNow)
+		if err != nil {
+			logger.Printf("ERROR Invalid credentials file %s: %s\n", watcher.Path, err.Error())
+		} else if changed {
+			logger.Printf("Reloaded credentials from %s\n", watcher.Path)
+		}
+	}
+}
+
+// Read, decode and validate a credentials file
+func loadCredentials(path string, timeNow time.Time) (Credentials, *CredentialValues, error) {
+	credentials, err := CredentialFile(path)
+	if err != nil {
+		return credentials, nil, err
+	}
+	values, err := credentials.Decode()
+	if err != nil {
+		return credentials, nil, err
+	}
+	if err = values.Validate(timeNow); err != nil {
+		return credentials, nil, err
+	}
+	return credentials, values, nil
+}
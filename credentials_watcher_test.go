@@ -0,0 +1,105 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a servo credentials file for the instance with the given IAM token
+func writeTestCredentials(t *testing.T, path string, instance *testCertificate, iamToken string, modTime time.Time) {
+	credentialsJson, err := json.Marshal(&Credentials{
+		InstancePublicKey: base64.StdEncoding.EncodeToString(pem.EncodeToMemory(
+			&pem.Block{Type: "CERTIFICATE", Bytes: instance.certificate.Raw})),
+		InstancePrivateKey: base64.StdEncoding.EncodeToString(pem.EncodeToMemory(
+			&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(instance.key)})),
+		IamToken: base64.StdEncoding.EncodeToString([]byte(iamToken)),
+	})
+	if err != nil {
+		t.Fatalf("Marshal error; %s", err.Error())
+	}
+	writeTestCredentialsFile(t, path, string(credentialsJson), modTime)
+}
+
+// Write a credentials file with the given content
+func writeTestCredentialsFile(t *testing.T, path string, credentialsJson string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(credentialsJson), 0600); err != nil {
+		t.Fatalf("WriteFile error; %s", err.Error())
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes error; %s", err.Error())
+	}
+}
+
+func TestCredentialsWatcherReload(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatalf("TempDir error; %s", err.Error())
+	}
+	defer os.RemoveAll(testDir)
+	credentialsPath := filepath.Join(testDir, "credentials.json")
+	modTime := time.Now().Add(-time.Hour)
+	validTime := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	if err := ioutil.WriteFile(credentialsPath, []byte(ExampleCredentials), 0600); err != nil {
+		t.Fatalf("WriteFile error; %s", err.Error())
+	}
+	_ = os.Chtimes(credentialsPath, modTime, modTime)
+
+	watcher := NewCredentialsWatcher(credentialsPath)
+	var notified []*CredentialValues
+	watcher.AddListener(func(_ Credentials, values *CredentialValues) {
+		notified = append(notified, values)
+	})
+	changed, err := watcher.Check(validTime)
+	assert.NoError(t, err, "initial check error")
+	assert.True(t, changed, "initial check loaded")
+	assert.Len(t, notified, 1, "listener notified on load")
+	changed, err = watcher.Check(validTime)
+	assert.NoError(t, err, "unchanged check error")
+	assert.False(t, changed, "unchanged check loaded")
+
+	// Invalid credentials are ignored and checked again
+	writeTestCredentialsFile(t, credentialsPath, `{"iam_token":"invalid token"}`, modTime.Add(time.Second))
+	changed, err = watcher.Check(validTime)
+	assert.Error(t, err, "invalid check error")
+	assert.False(t, changed, "invalid check loaded")
+	changed, err = watcher.Check(validTime)
+	assert.Error(t, err, "repeated invalid check error")
+	assert.False(t, changed, "repeated invalid check loaded")
+	credentials, values, generation := watcher.Current()
+	assert.Equal(t, 1, generation, "generation after invalid")
+	assert.NotNil(t, values.EucalyptusCertificate, "current values after invalid")
+	assert.NotEmpty(t, credentials.InstancePrivateKey, "current credentials after invalid")
+
+	// Expired certificates are invalid
+	if err := ioutil.WriteFile(credentialsPath, []byte(ExampleCredentials+" "), 0600); err != nil {
+		t.Fatalf("WriteFile error; %s", err.Error())
+	}
+	_, err = watcher.Check(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Error(t, err, "expired check error")
+
+	// An unchanged file that failed validation is loaded once valid
+	changed, err = watcher.Check(validTime)
+	assert.NoError(t, err, "recheck error")
+	assert.True(t, changed, "recheck loaded")
+	assert.Len(t, notified, 2, "listener notified on recheck")
+
+	writeTestCredentials(t, credentialsPath, generateTestCertificate(t, "i-00000001", nil), "token-2", modTime.Add(2*time.Second))
+	changed, err = watcher.Check(time.Now())
+	assert.NoError(t, err, "valid check error")
+	assert.True(t, changed, "valid check loaded")
+	_, values, generation = watcher.Current()
+	assert.Equal(t, 3, generation, "generation after reload")
+	assert.Equal(t, "token-2", string(values.IamToken), "reloaded credentials")
+	assert.Len(t, notified, 3, "listener notified on reload")
+}
@@ -6,16 +6,45 @@ package main
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
+// SecondaryPolicy is the failure policy for a secondary handler of a
+// CompositeHandler
+type SecondaryPolicy string
+
+const (
+	// Secondary handler failures are logged and do not fail the send
+	SecondaryBestEffort SecondaryPolicy = "best-effort"
+
+	// Secondary handler failures fail the send
+	SecondaryRequired SecondaryPolicy = "required"
+)
+
+// ActivityResultListener is optionally implemented by secondary handlers
+// of a CompositeHandler that are interested in values received by the
+// primary handler.
+type ActivityResultListener interface {
+	Received(name string, value string)
+}
+
 // ActivityHandler implementation using Channels
 type ChannelHandler struct {
 	Channels map[string]chan string
 }
 
 // ActivityHandler implementation using underlying handlers
+// The policies are the failure policies for the secondary handlers.
 type CompositeHandler struct {
 	Handlers []ActivityHandler
+	Policies []SecondaryPolicy
+}
+
+// ActivityHandler implementation that prefixes names for an underlying
+// handler, to separate the values for load balancers sharing a handler
+type PrefixedHandler struct {
+	Handler ActivityHandler
+	Prefix  string
 }
 
 // Create a new Channel backed ActivityHandler.
@@ -46,30 +75,92 @@ func (handler *ChannelHandler) Close() {
 
 // Create a CompositeHandler backed by the given handlers
 // The primary handler is used for both send and receive. Secondary handlers
-// are used for sending only (listeners)
-// A failure of the primary send will prevent secondary sends
-func NewCompositeHandler(primary ActivityHandler, secondaries ...ActivityHandler) ActivityHandler {
+// are used for sending only (listeners) and are notified of received values
+// if they implement ActivityResultListener
+// A failure of the primary send will prevent secondary sends. Secondary
+// handlers are best-effort, use Add for required secondary handlers.
+func NewCompositeHandler(primary ActivityHandler, secondaries ...ActivityHandler) *CompositeHandler {
 	Handler := &CompositeHandler{}
 	Handler.Handlers = append(Handler.Handlers, primary)
-	Handler.Handlers = append(Handler.Handlers, secondaries...)
+	for _, secondary := range secondaries {
+		Handler.Add(secondary, SecondaryBestEffort)
+	}
 	return Handler
 }
 
+// Add a secondary handler with the given failure policy
+func (handler *CompositeHandler) Add(secondary ActivityHandler, policy SecondaryPolicy) {
+	handler.Handlers = append(handler.Handlers, secondary)
+	handler.Policies = append(handler.Policies, policy)
+}
+
+// Send to the primary and then all secondary handlers
+// Failures of required secondary handlers are combined in the returned
+// error, the category is from the first failure.
 func (handler *CompositeHandler) Send(name string, value string) error {
 	err := handler.Handlers[0].Send(name, value)
-	if err == nil {
-		for _, secondary := range handler.Handlers[1:] {
-			_ = secondary.Send(name, value)
+	if err != nil {
+		return err
+	}
+	var requiredErrs []error
+	for index, secondary := range handler.Handlers[1:] {
+		secondaryErr := secondary.Send(name, value)
+		if secondaryErr == nil {
+			continue
+		}
+		if handler.Policies[index] == SecondaryRequired {
+			requiredErrs = append(requiredErrs, secondaryErr)
+		} else {
+			logger.Printf("WARNING Best-effort handler failed for %s: %s\n", name, secondaryErr.Error())
 		}
 	}
-
-	return err
+	return combineErrors(requiredErrs)
 }
 
 func (handler *CompositeHandler) Receive(name string) (*string, error) {
 	result, err := handler.Handlers[0].Receive(name)
+	if err == nil && result != nil {
+		for _, secondary := range handler.Handlers[1:] {
+			if listener, ok := secondary.(ActivityResultListener); ok {
+				listener.Received(name, *result)
+			}
+		}
+	}
 	return result, err
 }
 
 func (handler *CompositeHandler) Close() {
 }
+
+// Create a PrefixedHandler for the given handler and name prefix
+func NewPrefixedHandler(handler ActivityHandler, prefix string) ActivityHandler {
+	return &PrefixedHandler{handler, prefix}
+}
+
+func (handler *PrefixedHandler) Send(name string, value string) error {
+	return handler.Handler.Send(handler.Prefix+name, value)
+}
+
+func (handler *PrefixedHandler) Receive(name string) (*string, error) {
+	return handler.Handler.Receive(handler.Prefix + name)
+}
+
+func (handler *PrefixedHandler) Close() {
+	handler.Handler.Close()
+}
+
+// Combine errors from handlers, nil if there are no errors
+func combineErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	messages := make([]string, len(errs))
+	for index, err := range errs {
+		messages[index] = err.Error()
+	}
+	return NewActivityError(ActivityErrorCategoryOf(errs[0]), errors.New(fmt.Sprintf(
+		"%d handlers failed: %s", len(errs), strings.Join(messages, "; "))))
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// ActivityHandler that fails sends with the given error
+type failingActivityHandler struct {
+	err   error
+	sends int
+}
+
+func (handler *failingActivityHandler) Send(_ string, _ string) error {
+	handler.sends++
+	return handler.err
+}
+
+func (handler *failingActivityHandler) Receive(_ string) (*string, error) {
+	return nil, handler.err
+}
+
+func (handler *failingActivityHandler) Close() {
+}
+
+func TestCompositeHandlerBestEffort(t *testing.T) {
+	secondary := &failingActivityHandler{err: errors.New("secondary failed")}
+	handler := NewCompositeHandler(&recordingActivityHandler{sent: map[string]string{}}, secondary)
+	assert.NoError(t, handler.Send("set-loadbalancer", "value"), "best-effort failure")
+	assert.Equal(t, 1, secondary.sends, "secondary sends")
+}
+
+func TestCompositeHandlerRequired(t *testing.T) {
+	bestEffort := &failingActivityHandler{err: errors.New("best-effort failed")}
+	handler := NewCompositeHandler(&recordingActivityHandler{sent: map[string]string{}}, bestEffort)
+	handler.Add(&failingActivityHandler{
+		err: NewActivityError(ActivityErrorMissingPolicy, errors.New("policy not found"))}, SecondaryRequired)
+	err := handler.Send("set-loadbalancer", "value")
+	assert.EqualError(t, err, "policy not found", "required failure")
+	assert.Equal(t, ActivityErrorMissingPolicy, ActivityErrorCategoryOf(err), "required failure category")
+
+	handler.Add(&failingActivityHandler{err: errors.New("write failed")}, SecondaryRequired)
+	err = handler.Send("set-loadbalancer", "value")
+	assert.EqualError(t, err, "2 handlers failed: policy not found; write failed", "combined failure")
+	assert.Equal(t, ActivityErrorMissingPolicy, ActivityErrorCategoryOf(err), "combined failure category")
+	assert.Equal(t, 2, bestEffort.sends, "best-effort sends")
+}
+
+func TestCompositeHandlerPrimaryFailure(t *testing.T) {
+	secondary := &failingActivityHandler{}
+	handler := NewCompositeHandler(&failingActivityHandler{err: errors.New("primary failed")})
+	handler.Add(secondary, SecondaryRequired)
+	assert.EqualError(t, handler.Send("set-loadbalancer", "value"), "primary failed", "primary failure")
+	assert.Equal(t, 0, secondary.sends, "secondary sends after primary failure")
+}
+
+// A load balancer that cannot be configured fails the activity task
+func TestSetLoadBalancerConfigurationFailure(t *testing.T) {
+	testRunDir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(testRunDir)
+	templatePath := fmt.Sprintf("%s/haproxy-template.conf", testRunDir)
+	if err = ioutil.WriteFile(templatePath, []byte(TemplateConf), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	savedFactory, savedGrace := ActivityHandlerFactory, PendingLoadBalancerGrace
+	defer func() { ActivityHandlerFactory, PendingLoadBalancerGrace = savedFactory, savedGrace }()
+	ActivityHandlerFactory = func() (ActivityHandler, error) {
+		return &fakeActivityHandler{time.Millisecond}, nil
+	}
+	PendingLoadBalancerGrace = 0
+
+	lb := NewLoadBalancerContext("domain", "tasks", testRunDir, 0)
+	lb.ConfigurationTemplate = templatePath
+	loadBalancer := ExampleLoadBalancer
+	client := newFakeSwfClient([]*SwfActivityTask{
+		activityTask("loadbalancer", "LoadBalancingVmActivities.setLoadBalancer", &loadBalancer),
+	})
+	assert.NoError(t, pollActivityTask(context.Background(), client, lb), "poll error")
+	assert.Contains(t, client.failed["loadbalancer"], "policy not found", "failed task message")
+	assert.Equal(t, ActivityErrorMissingPolicy, client.categories["loadbalancer"], "failed task category")
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/haproxytech/config-parser/v2"
@@ -12,24 +13,86 @@ import (
 	"github.com/haproxytech/config-parser/v2/parsers/http/actions"
 	"github.com/haproxytech/config-parser/v2/types"
 	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-var PolicyCache = &HAproxyPolicyCache{map[string]ActivityPolicy{}}
+var PolicyCache = &HAproxyPolicyCache{Policies: map[string]ActivityPolicy{}, StatusSection: StatusSectionConfiguration}
+
+// Serializes configuration generation and output
+var configurationMutex sync.Mutex
+
+// Grace period for a load balancer waiting for referenced policies, after
+// which it is configured without the missing policies. A load balancer with
+// missing policies fails if there is no grace period.
+var PendingLoadBalancerGrace = 60 * time.Second
+
+const (
+	// Status section for HAProxy configuration
+	StatusSectionConfiguration = "configuration"
+
+	// Configuration state when the load balancer is configured
+	ConfigurationConfigured = "configured"
+
+	// Configuration state when the load balancer is waiting for policies
+	ConfigurationPending = "pending"
+
+	// Configuration state when the load balancer could not be configured
+	ConfigurationFailed = "failed"
+)
+
+// ConfigurationStatus is the status output for HAProxy configuration
+type ConfigurationStatus struct {
+	State           string   `json:"state"`
+	LoadBalancer    string   `json:"load-balancer"`
+	MissingPolicies []string `json:"missing-policies,omitempty"`
+	LastError       string   `json:"last-error,omitempty"`
+	Since           string   `json:"since"`
+}
 
 // HA-Proxy configuration
 type HaproxyConfiguration struct {
 	Parser *parser.Parser
 }
 
+// HAproxyPolicyCache holds policies by name, safe for concurrent use
+// The cache also holds the latest load balancer if it is waiting for
+// policies and the last configured load balancer, these are guarded by the
+// configuration mutex. Policies and the last configured load balancer are
+// saved to the state directory, if any. The configuration status is output
+// to the status section, if any.
 type HAproxyPolicyCache struct {
-	Policies map[string]ActivityPolicy
+	mutex          sync.RWMutex
+	Policies       map[string]ActivityPolicy
+	StateDirectory string
+	StatusSection  string
+	pending        *pendingLoadBalancer
+	stopped        bool
+	loadBalancer   *ActivityLoadBalancer
+
+	// Called without the cache lock held with the names of purged policies
+	OnPurge func(policyNames []string)
+}
+
+// A load balancer waiting for policies and the handler to configure it
+type pendingLoadBalancer struct {
+	loadBalancer ActivityLoadBalancer
+	handler      HaproxyConfigurationHandler
+	timer        *time.Timer
 }
 
 // ActivityHandler implementation for receiving configuration
+// Policies and backend instances are from the given cache and health state.
 type HaproxyConfigurationHandler struct {
 	TemplateSupplier      func() (string, error)
 	ConfigurationReceiver func(string) error
+	Policies              *HAproxyPolicyCache
+	Health                *AgentHealthState
+	AgentChecks           *AgentCheckServerGroup
 }
 
 func HaproxyConfigurationString(configuration string) (haproxyConfiguration *HaproxyConfiguration, err error) {
@@ -82,8 +145,11 @@ func NewHaproxyConfigurationHandler(templatePath string, configurationPath strin
 		return ioutil.WriteFile(configurationPath, []byte(data), 0600)
 	}
 	handler := &HaproxyConfigurationHandler{
-		templateFromFile,
-		configurationToFile,
+		TemplateSupplier:      templateFromFile,
+		ConfigurationReceiver: configurationToFile,
+		Policies:              PolicyCache,
+		Health:                InstanceHealth,
+		AgentChecks:           AgentCheckServers,
 	}
 	return handler
 }
@@ -105,58 +171,237 @@ func (handler *HaproxyConfigurationHandler) Receive(_ string) (*string, error) {
 func (handler *HaproxyConfigurationHandler) Close() {
 }
 
+// Cache policies and configure any pending load balancer that has all
+// referenced policies
+// No policies are cached when there are invalid policies in the value, the
+// returned error lists the invalid policies. Policies are cached under the
+// configuration mutex so that a concurrent load balancer configuration
+// cannot purge a policy as it arrives.
 func (handler *HaproxyConfigurationHandler) HandlePolicy(policy string) error {
-	activityDescriptions, err := ActivityDescriptionsString(policy)
-	if err == nil &&
-		len(activityDescriptions.LoadBalancers) == 1 &&
-		len(activityDescriptions.LoadBalancers[0].PolicyDescriptions) == 1 {
-		name := activityDescriptions.LoadBalancers[0].PolicyDescriptions[0].PolicyName
-		activityPolicy := activityDescriptions.LoadBalancers[0].PolicyDescriptions[0]
-		PolicyCache.Policies[name] = activityPolicy
+	policies, err := ActivityPoliciesString(policy)
+	if err != nil || len(policies) == 0 {
+		return err
 	}
-	return err
+	configurationMutex.Lock()
+	defer configurationMutex.Unlock()
+	for _, activePolicy := range policies {
+		handler.Policies.Put(activePolicy)
+	}
+	handler.Policies.saveState()
+	pending := handler.Policies.pending
+	if pending != nil {
+		if _, _, missing := handler.Policies.Resolve(&pending.loadBalancer); len(missing) == 0 {
+			logger.Printf("Configuring pending load balancer %s\n", pending.loadBalancer.LoadBalancerName)
+			handler.Policies.setPending(nil)
+			return handler.configureLoadBalancer(pending.loadBalancer, false)
+		}
+	}
+	return nil
 }
 
+// Configure a load balancer, the load balancer is pending if any
+// referenced policies are not yet cached
 func (handler *HaproxyConfigurationHandler) HandleLoadBalancer(loadBalancer string) error {
+	configurationMutex.Lock()
+	defer configurationMutex.Unlock()
 	activityDescriptions, err := ActivityDescriptionsString(loadBalancer)
 	if err == nil &&
 		len(activityDescriptions.LoadBalancers) == 1 &&
 		len(activityDescriptions.LoadBalancers[0].PolicyDescriptions) == 0 {
-		loadBalancer := activityDescriptions.LoadBalancers[0]
-		activePolicyNames := map[string]string{}
-		for _, listener := range loadBalancer.Listeners {
-			for _, policyName := range listener.PolicyNames {
-				activePolicyNames[policyName] = policyName
-			}
+		handler.Policies.setPending(nil)
+		return handler.configureLoadBalancer(activityDescriptions.LoadBalancers[0], false)
+	}
+	return err
+}
+
+// Configure a load balancer with its referenced policies
+// Must be called with the configuration mutex held. If policies are missing
+// the load balancer is pending until the policies arrive or the grace period
+// expires, when it is configured without the missing policies (force). A
+// pending load balancer is reported in the configuration status.
+func (handler *HaproxyConfigurationHandler) configureLoadBalancer(loadBalancer ActivityLoadBalancer, force bool) error {
+	policies, activePolicyNames, missing := handler.Policies.Resolve(&loadBalancer)
+	if len(missing) > 0 && !force {
+		if PendingLoadBalancerGrace <= 0 || handler.Policies.stopped {
+			err := NewActivityError(ActivityErrorMissingPolicy,
+				errors.New(fmt.Sprintf("policy not found %s", strings.Join(missing, ","))))
+			handler.Policies.setStatus(ConfigurationFailed, &loadBalancer, missing, err)
+			return err
 		}
-		for _, backend := range loadBalancer.BackendServers {
-			for _, policyName := range backend.PolicyNames {
-				activePolicyNames[policyName] = policyName
-			}
+		logger.Printf("WARNING Load balancer %s pending policies %s, configuring without them in %s\n",
+			loadBalancer.LoadBalancerName, strings.Join(missing, ","), PendingLoadBalancerGrace)
+		handler.Policies.setStatus(ConfigurationPending, &loadBalancer, missing, nil)
+		pending := &pendingLoadBalancer{loadBalancer: loadBalancer, handler: *handler}
+		pending.timer = time.AfterFunc(PendingLoadBalancerGrace, func() {
+			pending.handler.pendingTimeout(pending)
+		})
+		handler.Policies.setPending(pending)
+		return nil
+	}
+	if len(missing) > 0 {
+		logger.Printf("WARNING Configuring load balancer %s without missing policies %s\n",
+			loadBalancer.LoadBalancerName, strings.Join(missing, ","))
+	}
+	configuredLoadBalancer := loadBalancer
+	loadBalancer.PolicyDescriptions = policies
+	handler.Policies.RetainOnly(activePolicyNames)
+	if err := handler.WriteConfiguration(&loadBalancer); err != nil {
+		handler.Policies.setStatus(ConfigurationFailed, &loadBalancer, missing, err)
+		return err
+	}
+	handler.Policies.loadBalancer = &configuredLoadBalancer
+	handler.Policies.saveState()
+	handler.Policies.setStatus(ConfigurationConfigured, &loadBalancer, missing, nil)
+	return nil
+}
+
+// Regenerate the configuration for the last configured load balancer
+// Returns false if there is no load balancer to configure. The generated
+// configuration is verified before output.
+func (handler *HaproxyConfigurationHandler) Restore() (bool, error) {
+	configurationMutex.Lock()
+	defer configurationMutex.Unlock()
+	loadBalancer := handler.Policies.loadBalancer
+	if loadBalancer == nil {
+		return false, nil
+	}
+	verifyingHandler := *handler
+	verifyingHandler.ConfigurationReceiver = func(configuration string) error {
+		if err := VerifyConfiguration(configuration); err != nil {
+			return err
 		}
-		for _, policyName := range activePolicyNames {
-			if activePolicy, ok := PolicyCache.Policies[policyName]; ok {
-				loadBalancer.PolicyDescriptions = append(loadBalancer.PolicyDescriptions, activePolicy)
-			} else {
-				return errors.New(fmt.Sprintf("policy not found %s", policyName))
-			}
+		return handler.ConfigurationReceiver(configuration)
+	}
+	return true, verifyingHandler.configureLoadBalancer(*loadBalancer, true)
+}
+
+// Verify that a configuration is valid and has frontends and backends
+func VerifyConfiguration(configuration string) error {
+	haproxyConfiguration, err := HaproxyConfigurationString(configuration)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid configuration: %s", err.Error()))
+	}
+	for _, section := range []parser.Section{parser.Frontends, parser.Backends} {
+		names, err := haproxyConfiguration.Parser.SectionsGet(section)
+		if err != nil || len(names) == 0 {
+			return errors.New(fmt.Sprintf("invalid configuration: no %s", section))
 		}
-		PolicyCache.RetainOnly(activePolicyNames)
-		return handler.WriteConfiguration(&loadBalancer)
 	}
-	return err
+	return nil
+}
+
+// Configure a load balancer that is still pending after the grace period
+func (handler *HaproxyConfigurationHandler) pendingTimeout(pending *pendingLoadBalancer) {
+	configurationMutex.Lock()
+	defer configurationMutex.Unlock()
+	if handler.Policies.pending != pending {
+		return
+	}
+	handler.Policies.pending = nil
+	if err := handler.configureLoadBalancer(pending.loadBalancer, true); err != nil {
+		logger.Printf("ERROR Configuring pending load balancer %s failed: %s\n",
+			pending.loadBalancer.LoadBalancerName, err.Error())
+	}
+}
+
+// Stop waiting for policies, any pending load balancer is not configured
+// Load balancers with missing policies fail once stopped.
+func (cache *HAproxyPolicyCache) StopPending() {
+	configurationMutex.Lock()
+	defer configurationMutex.Unlock()
+	cache.stopped = true
+	cache.setPending(nil)
+}
+
+// Output the configuration status for a load balancer, if there is a
+// status section. Must be called with the configuration mutex held.
+func (cache *HAproxyPolicyCache) setStatus(state string, loadBalancer *ActivityLoadBalancer, missing []string, err error) {
+	if cache.StatusSection == "" {
+		return
+	}
+	status := ConfigurationStatus{
+		State:           state,
+		LoadBalancer:    loadBalancer.LoadBalancerName,
+		MissingPolicies: missing,
+		Since:           time.Now().UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	Status.Set(cache.StatusSection, status)
+}
+
+// Add or replace a cached policy
+func (cache *HAproxyPolicyCache) Put(policy ActivityPolicy) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.Policies[policy.PolicyName] = policy
+}
+
+// Get a cached policy by name
+func (cache *HAproxyPolicyCache) Get(policyName string) (policy ActivityPolicy, ok bool) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	policy, ok = cache.Policies[policyName]
+	return
+}
+
+// Get the cached policies referenced by a load balancer
+// Returns the policies sorted by name, the names of all referenced policies
+// and the sorted names of referenced policies that are not cached.
+func (cache *HAproxyPolicyCache) Resolve(loadBalancer *ActivityLoadBalancer) (policies []ActivityPolicy, activePolicyNames map[string]string, missing []string) {
+	activePolicyNames = map[string]string{}
+	for _, listener := range loadBalancer.Listeners {
+		for _, policyName := range listener.PolicyNames {
+			activePolicyNames[policyName] = policyName
+		}
+	}
+	for _, backend := range loadBalancer.BackendServers {
+		for _, policyName := range backend.PolicyNames {
+			activePolicyNames[policyName] = policyName
+		}
+	}
+	policyNames := make([]string, 0, len(activePolicyNames))
+	for policyName := range activePolicyNames {
+		policyNames = append(policyNames, policyName)
+	}
+	sort.Strings(policyNames)
+	for _, policyName := range policyNames {
+		if activePolicy, ok := cache.Get(policyName); ok {
+			policies = append(policies, activePolicy)
+		} else {
+			missing = append(missing, policyName)
+		}
+	}
+	return
+}
+
+// Set the pending load balancer, stopping the grace timer for any
+// previously pending load balancer. Must be called with the configuration
+// mutex held.
+func (cache *HAproxyPolicyCache) setPending(pending *pendingLoadBalancer) {
+	if cache.pending != nil {
+		cache.pending.timer.Stop()
+	}
+	cache.pending = pending
 }
 
 // Purge stale cached items by retaining only keys from the given map
 func (cache *HAproxyPolicyCache) RetainOnly(retainKeys map[string]string) {
+	cache.mutex.Lock()
 	var stalePolicyNames []string
-	for policyName := range PolicyCache.Policies {
+	for policyName := range cache.Policies {
 		if _, ok := retainKeys[policyName]; !ok {
 			stalePolicyNames = append(stalePolicyNames, policyName)
 		}
 	}
 	for _, policyName := range stalePolicyNames {
-		delete(PolicyCache.Policies, policyName)
+		delete(cache.Policies, policyName)
+	}
+	onPurge := cache.OnPurge
+	cache.mutex.Unlock()
+	if onPurge != nil && len(stalePolicyNames) > 0 {
+		onPurge(stalePolicyNames)
 	}
 }
 
@@ -169,7 +414,7 @@ func (handler *HaproxyConfigurationHandler) WriteConfiguration(loadBalancer *Act
 	if err != nil {
 		return err
 	}
-	err = UpdateConfiguration(haproxyConfiguration, loadBalancer)
+	err = UpdateConfigurationServers(haproxyConfiguration, loadBalancer, handler.Health, handler.AgentChecks)
 	if err != nil {
 		return err
 	}
@@ -193,38 +438,117 @@ func UpdateConfigurationSection(haproxyConfiguration *HaproxyConfiguration, sect
 	return nil
 }
 
-// Proof of concept configuration update
-// The given loadBalancer should be used to generate configuration. Currently
-// values are hard-coded for testing configuration output.
+// Configuration update for the given load balancer with servers from the
+// agents health state
 func UpdateConfiguration(haproxyConfiguration *HaproxyConfiguration, loadBalancer *ActivityLoadBalancer) error {
+	return UpdateConfigurationServers(haproxyConfiguration, loadBalancer, InstanceHealth, AgentCheckServers)
+}
+
+// Configuration update with servers from the given health state
+// A frontend and backend is configured for each listener, backend servers
+// use the listeners instance port. HTTP and HTTPS listeners are configured
+// in http mode, other listeners in tcp mode.
+func UpdateConfigurationServers(haproxyConfiguration *HaproxyConfiguration, loadBalancer *ActivityLoadBalancer,
+	health *AgentHealthState, agentChecks *AgentCheckServerGroup) error {
+	listeners := make([]ActivityLoadBalancerListener, len(loadBalancer.Listeners))
+	copy(listeners, loadBalancer.Listeners)
+	sort.Slice(listeners, func(i, j int) bool {
+		return listeners[i].LoadBalancerPort < listeners[j].LoadBalancerPort
+	})
+	for _, listener := range listeners {
+		if err := updateConfigurationListener(haproxyConfiguration, loadBalancer, listener, health, agentChecks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateConfigurationListener(haproxyConfiguration *HaproxyConfiguration, loadBalancer *ActivityLoadBalancer,
+	listener ActivityLoadBalancerListener, health *AgentHealthState, agentChecks *AgentCheckServerGroup) error {
+	backendName := BackendName(listener)
+	loadBalancerPort := strconv.Itoa(int(listener.LoadBalancerPort))
+	httpMode := listenerHttpMode(listener.Protocol)
 	frontendAttributes := map[string]common.ParserData{}
-	frontendAttributes["mode"] = configStringC("http")
-	frontendAttributes["bind"] = &types.Bind{Path: "0.0.0.0:8080"}
-	frontendAttributes["log-format"] = configStringC("httplog %Ts %ci %cp %si %sp %Tq %Tw %Tc %Tr %Tt %ST %U %B %f %b %s %ts %r %hrl")
-	frontendAttributes["log"] = &types.Log{Address: "/var/lib/load-balancer-servo/haproxy.sock", Facility: "local2", Level: "info"}
-	frontendAttributes["option forwardfor"] = &types.OptionForwardFor{Except: "127.0.0.1"}
+	frontendAttributes["bind"] = &types.Bind{Path: net.JoinHostPort(LocalInstance.BindAddress(loadBalancer.Scheme), loadBalancerPort)}
+	frontendAttributes["log"] = &types.Log{Address: HaproxyLogSocket, Facility: "local2", Level: "info"}
 	frontendAttributes["timeout client"] = &types.SimpleTimeout{Value: "60s"}
-	frontendAttributes["default_backend"] = configStringC("backend-http-8080")
-	frontendAttributes["http-request"] = []types.HTTPAction{
-		&actions.SetHeader{Name: "X-Forwarded-Proto", Fmt: "http"},
-		&actions.SetHeader{Name: "X-Forwarded-Port", Fmt: "8080"},
-		//TODO syntax not supported by haproxy 1.5
-		// &actions.Capture{Sample: "hdr(User-Agent)", Len: configInt64(8192)},
-	}
-	err := UpdateConfigurationSection(haproxyConfiguration, parser.Frontends, "http-8080", frontendAttributes)
+	frontendAttributes["default_backend"] = configStringC(backendName)
+	if httpMode {
+		frontendAttributes["mode"] = configStringC("http")
+		frontendAttributes["log-format"] = configStringC("httplog %Ts %ci %cp %si %sp %Tq %Tw %Tc %Tr %Tt %ST %U %B %f %b %s %ts %r %hrl")
+		frontendAttributes["option forwardfor"] = &types.OptionForwardFor{Except: "127.0.0.1"}
+		frontendAttributes["http-request"] = []types.HTTPAction{
+			&actions.SetHeader{Name: "X-Forwarded-Proto", Fmt: strings.ToLower(listener.Protocol)},
+			&actions.SetHeader{Name: "X-Forwarded-Port", Fmt: loadBalancerPort},
+			//TODO syntax not supported by haproxy 1.5
+			// &actions.Capture{Sample: "hdr(User-Agent)", Len: configInt64(8192)},
+		}
+	} else {
+		frontendAttributes["mode"] = configStringC("tcp")
+	}
+	err := UpdateConfigurationSection(haproxyConfiguration, parser.Frontends, FrontendName(listener), frontendAttributes)
 	if err != nil {
 		return err
 	}
 
 	backendAttributes := map[string]common.ParserData{}
-	backendAttributes["mode"] = configStringC("http")
-	backendAttributes["balance"] = &types.Balance{"roundrobin", nil, ""}
-	backendAttributes["http-response"] = &actions.SetHeader{Name: "Cache-control", Fmt: `no-cache="set-cookie"`}
-	backendAttributes["cookie"] = &types.Cookie{Name: "AWSELB", Type: "insert", Indirect: true, Maxidle: 300000, Maxlife: 300000}
-	backendAttributes["server"] = []types.Server{{Name: "http-8080", Address: "10.111.10.215:8080", Params: []params.ServerOption{&params.ServerOptionValue{Name: "cookie", Value: "MTAuMTExLjEwLjIxNQ=="}}}}
+	backendAttributes["balance"] = &types.Balance{Algorithm: "roundrobin"}
 	backendAttributes["timeout server"] = &types.SimpleTimeout{Value: "60s"}
-	err = UpdateConfigurationSection(haproxyConfiguration, parser.Backends, "backend-http-8080", backendAttributes)
-	return err
+	if httpMode {
+		backendAttributes["mode"] = configStringC("http")
+		backendAttributes["http-response"] = &actions.SetHeader{Name: "Cache-control", Fmt: `no-cache="set-cookie"`}
+		backendAttributes["cookie"] = &types.Cookie{Name: "AWSELB", Type: "insert", Indirect: true, Maxidle: 300000, Maxlife: 300000}
+	} else {
+		backendAttributes["mode"] = configStringC("tcp")
+	}
+	if servers := configServers(health, agentChecks, backendName, listener.InstancePort, httpMode); len(servers) > 0 {
+		backendAttributes["server"] = servers
+	}
+	return UpdateConfigurationSection(haproxyConfiguration, parser.Backends, backendName, backendAttributes)
+}
+
+// The agent-send string for an instance, newline terminated so that the
+// agent-check responder does not wait for the read timeout
+func agentSend(instanceId string) string {
+	return fmt.Sprintf(`"%s\n"`, instanceId)
+}
+
+// The HAProxy frontend name for a listener, e.g. http-8080
+func FrontendName(listener ActivityLoadBalancerListener) string {
+	return fmt.Sprintf("%s-%d", strings.ToLower(listener.Protocol), listener.LoadBalancerPort)
+}
+
+func listenerHttpMode(protocol string) bool {
+	return strings.EqualFold(protocol, "HTTP") || strings.EqualFold(protocol, "HTTPS")
+}
+
+// Servers for a backend from the agents view of the backend instances
+// Draining instances are included so that existing sessions can complete.
+// Servers use the agent-check when there is a responder for the backend and
+// the sticky session cookie in http mode. There are no servers when there
+// are no backend instances.
+func configServers(health *AgentHealthState, agentChecks *AgentCheckServerGroup, backend string, instancePort int32, cookies bool) []types.Server {
+	agentPort := agentChecks.Port(backend)
+	var servers []types.Server
+	for _, instanceState := range health.InstanceStates() {
+		var serverParams []params.ServerOption
+		if cookies {
+			serverParams = append(serverParams,
+				&params.ServerOptionValue{Name: "cookie", Value: base64.StdEncoding.EncodeToString([]byte(instanceState.InstanceIpAddress))})
+		}
+		if agentPort > 0 {
+			serverParams = append(serverParams,
+				&params.ServerOptionWord{Name: "agent-check"},
+				&params.ServerOptionValue{Name: "agent-port", Value: strconv.Itoa(agentPort)},
+				&params.ServerOptionValue{Name: "agent-send", Value: agentSend(instanceState.InstanceId)})
+		}
+		servers = append(servers, types.Server{
+			Name:    instanceState.InstanceId,
+			Address: net.JoinHostPort(instanceState.InstanceIpAddress, strconv.Itoa(int(instancePort))),
+			Params:  serverParams,
+		})
+	}
+	return servers
 }
 
 func configInt64(value int64) *int64 {
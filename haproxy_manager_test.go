@@ -4,7 +4,14 @@
 package main
 
 import (
+	"github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/params"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const TemplateConf = `#template
@@ -80,6 +87,56 @@ func TestHaproxyConf(t *testing.T) {
 	t.Log(configuration.Parser.String())
 }
 
+func TestUpdateConfigurationListeners(t *testing.T) {
+	configuration, err := HaproxyConfigurationString(TemplateConf)
+	if err != nil {
+		t.Fatalf("HaproxyConfigurationString(TemplateConf) error; %s", err.Error())
+	}
+	loadBalancer := &ActivityLoadBalancer{
+		Listeners: []ActivityLoadBalancerListener{
+			{Protocol: "HTTP", LoadBalancerPort: 80, InstancePort: 8080},
+			{Protocol: "TCP", LoadBalancerPort: 2222, InstancePort: 22},
+		},
+	}
+	agentChecks := NewAgentCheckServerGroup()
+	agentChecks.Servers["backend-http-80"] = &AgentCheckServer{Backend: "backend-http-80", Port: 7001}
+	health := NewAgentHealthState()
+	assert.NoError(t, UpdateConfigurationServers(configuration, loadBalancer, health, agentChecks), "update without instances")
+	for _, frontend := range []string{"http-80", "tcp-2222"} {
+		_, err = configuration.Parser.Get(parser.Frontends, frontend, "bind")
+		assert.NoError(t, err, "frontend "+frontend)
+	}
+	_, err = configuration.Parser.Get(parser.Backends, "backend-http-80", "server")
+	assert.Error(t, err, "backend servers without instances")
+	assert.NotContains(t, configuration.String(), "8080", "instance port without instances")
+
+	health.UpdateInstances([]ActivityBackendInstance{{InstanceId: "i-00000001", InstanceIpAddress: "10.111.10.216"}},
+		false, 0, time.Now())
+	configuration, err = HaproxyConfigurationString(TemplateConf)
+	if err != nil {
+		t.Fatalf("HaproxyConfigurationString(TemplateConf) error; %s", err.Error())
+	}
+	assert.NoError(t, UpdateConfigurationServers(configuration, loadBalancer, health, agentChecks), "update with instances")
+	server, err := configuration.Parser.Get(parser.Backends, "backend-http-80", "server")
+	if assert.NoError(t, err, "http backend servers") {
+		servers := server.([]types.Server)
+		if assert.Len(t, servers, 1, "http backend servers") {
+			assert.Equal(t, "10.111.10.216:8080", servers[0].Address, "http server instance port")
+			assert.Contains(t, params.ServerOptionsString(servers[0].Params), "agent-port 7001", "http server agent port")
+			assert.Contains(t, params.ServerOptionsString(servers[0].Params), `agent-send "i-00000001\n"`, "http server agent send")
+		}
+	}
+	server, err = configuration.Parser.Get(parser.Backends, "backend-tcp-2222", "server")
+	if assert.NoError(t, err, "tcp backend servers") {
+		servers := server.([]types.Server)
+		if assert.Len(t, servers, 1, "tcp backend servers") {
+			assert.Equal(t, "10.111.10.216:22", servers[0].Address, "tcp server instance port")
+			assert.NotContains(t, params.ServerOptionsString(servers[0].Params), "agent-port", "tcp server without agent port")
+		}
+	}
+	assert.NoError(t, VerifyConfiguration(configuration.String()), "generated configuration")
+}
+
 func TestHaproxyConfigurationHandler(t *testing.T) {
 	templateStatic := func() (string, error) {
 		return TemplateConf, nil
@@ -90,7 +147,10 @@ func TestHaproxyConfigurationHandler(t *testing.T) {
 	}
 	handler := &HaproxyConfigurationHandler{
 		templateStatic,
-		configurationLogger}
+		configurationLogger,
+		PolicyCache,
+		InstanceHealth,
+		AgentCheckServers}
 	err := handler.Send("set-policy", ExamplePolicy)
 	if err != nil {
 		t.Fatal(err.Error())
@@ -100,3 +160,166 @@ func TestHaproxyConfigurationHandler(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 }
+
+// Handler for tests with a cache of its own that records configurations
+func testPendingConfigurationHandler(configurations chan string) *HaproxyConfigurationHandler {
+	return &HaproxyConfigurationHandler{
+		func() (string, error) { return TemplateConf, nil },
+		func(data string) error {
+			configurations <- data
+			return nil
+		},
+		&HAproxyPolicyCache{Policies: map[string]ActivityPolicy{}, StatusSection: "configuration:test"},
+		NewAgentHealthState(),
+		NewAgentCheckServerGroup()}
+}
+
+// Get the configuration status for a test handler
+func testConfigurationStatus(t *testing.T) ConfigurationStatus {
+	status, ok := Status.Get("configuration:test")
+	if !ok {
+		t.Fatal("configuration status not set")
+	}
+	return status.(ConfigurationStatus)
+}
+
+// A load balancer is configured when the referenced policies arrive
+func TestHaproxyConfigurationHandlerPendingPolicy(t *testing.T) {
+	configurations := make(chan string, 2)
+	handler := testPendingConfigurationHandler(configurations)
+	assert.NoError(t, handler.Send("set-loadbalancer", ExampleLoadBalancer), "pending load balancer")
+	assert.Len(t, configurations, 0, "configurations while pending")
+	status := testConfigurationStatus(t)
+	assert.Equal(t, ConfigurationPending, status.State, "status while pending")
+	assert.Equal(t, []string{"sticky"}, status.MissingPolicies, "missing policies status while pending")
+	assert.NoError(t, handler.Send("set-policy", ExamplePolicy), "policy for pending load balancer")
+	assert.Len(t, configurations, 1, "configurations after policy")
+	assert.Equal(t, ConfigurationConfigured, testConfigurationStatus(t).State, "status after policy")
+	configurationMutex.Lock()
+	assert.Nil(t, handler.Policies.pending, "pending after policy")
+	configurationMutex.Unlock()
+	assert.NoError(t, handler.Send("set-policy", ExamplePolicy), "policy update")
+	assert.Len(t, configurations, 1, "configurations after policy update")
+}
+
+// A pending load balancer is configured without missing policies after the
+// grace period
+func TestHaproxyConfigurationHandlerPendingGrace(t *testing.T) {
+	savedGrace := PendingLoadBalancerGrace
+	defer func() { PendingLoadBalancerGrace = savedGrace }()
+	PendingLoadBalancerGrace = 50 * time.Millisecond
+	configurations := make(chan string, 2)
+	handler := testPendingConfigurationHandler(configurations)
+	assert.NoError(t, handler.Send("set-loadbalancer", ExampleLoadBalancer), "pending load balancer")
+	select {
+	case configuration := <-configurations:
+		assert.Contains(t, configuration, "backend-http-8080", "configuration after grace")
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending load balancer not configured after grace")
+	}
+	configurationMutex.Lock()
+	assert.Nil(t, handler.Policies.pending, "pending after grace")
+	configurationMutex.Unlock()
+}
+
+// A pending load balancer is not configured once stopped
+func TestHaproxyConfigurationHandlerPendingStopped(t *testing.T) {
+	savedGrace := PendingLoadBalancerGrace
+	defer func() { PendingLoadBalancerGrace = savedGrace }()
+	PendingLoadBalancerGrace = 50 * time.Millisecond
+	configurations := make(chan string, 2)
+	handler := testPendingConfigurationHandler(configurations)
+	assert.NoError(t, handler.Send("set-loadbalancer", ExampleLoadBalancer), "pending load balancer")
+	handler.Policies.StopPending()
+	time.Sleep(2 * PendingLoadBalancerGrace)
+	assert.Len(t, configurations, 0, "configurations after stop")
+	err := handler.Send("set-loadbalancer", ExampleLoadBalancer)
+	assert.Equal(t, ActivityErrorMissingPolicy, ActivityErrorCategoryOf(err), "missing policy after stop")
+	assert.Equal(t, ConfigurationFailed, testConfigurationStatus(t).State, "status after stop")
+}
+
+// A newer load balancer replaces the pending load balancer
+func TestHaproxyConfigurationHandlerPendingReplaced(t *testing.T) {
+	configurations := make(chan string, 2)
+	handler := testPendingConfigurationHandler(configurations)
+	assert.NoError(t, handler.Send("set-loadbalancer", ExampleLoadBalancer), "pending load balancer")
+	withoutPolicy := strings.Replace(ExampleLoadBalancer, "<PolicyNames><member>sticky</member></PolicyNames>", "", 1)
+	assert.NoError(t, handler.Send("set-loadbalancer", withoutPolicy), "load balancer without policies")
+	assert.Len(t, configurations, 1, "configurations for load balancer without policies")
+	assert.NoError(t, handler.Send("set-policy", ExamplePolicy), "policy for replaced load balancer")
+	assert.Len(t, configurations, 1, "configurations after policy for replaced load balancer")
+}
+
+// Policies and load balancers handled concurrently are serialized
+func TestHaproxyConfigurationHandlerConcurrent(t *testing.T) {
+	configurations := make(chan string, 100)
+	handler := testPendingConfigurationHandler(configurations)
+	var handlers sync.WaitGroup
+	for index := 0; index < 10; index++ {
+		handlers.Add(2)
+		go func() {
+			defer handlers.Done()
+			assert.NoError(t, handler.Send("set-policy", ExamplePolicy), "concurrent policy")
+		}()
+		go func() {
+			defer handlers.Done()
+			assert.NoError(t, handler.Send("set-loadbalancer", ExampleLoadBalancer), "concurrent load balancer")
+		}()
+	}
+	handlers.Wait()
+	_, ok := handler.Policies.Get("sticky")
+	assert.True(t, ok, "referenced policy cached")
+	assert.NotEmpty(t, configurations, "configurations")
+	configurationMutex.Lock()
+	assert.Nil(t, handler.Policies.pending, "pending after policies")
+	configurationMutex.Unlock()
+}
+
+// No policies are cached when a value includes invalid policies
+func TestHaproxyConfigurationHandlerPolicies(t *testing.T) {
+	handler := testPendingConfigurationHandler(make(chan string, 1))
+	err := handler.Send("set-policy", ExamplePolicies)
+	assert.Error(t, err, "invalid policy")
+	assert.Equal(t, ActivityErrorInvalidInput, ActivityErrorCategoryOf(err), "invalid policy category")
+	for _, policyName := range []string{"sticky", "app-sticky", "tls"} {
+		_, ok := handler.Policies.Get(policyName)
+		assert.False(t, ok, "cached policy %s", policyName)
+	}
+}
+
+// Resolved policies are ordered by name
+func TestHAproxyPolicyCacheResolve(t *testing.T) {
+	cache := &HAproxyPolicyCache{Policies: map[string]ActivityPolicy{}}
+	loadBalancer := &ActivityLoadBalancer{}
+	for _, policyName := range []string{"tls", "sticky", "app-sticky", "cookie", "backend"} {
+		cache.Put(ActivityPolicy{PolicyName: policyName})
+		loadBalancer.Listeners = append(loadBalancer.Listeners, ActivityLoadBalancerListener{PolicyNames: []string{policyName}})
+	}
+	loadBalancer.Listeners = append(loadBalancer.Listeners, ActivityLoadBalancerListener{PolicyNames: []string{"missing"}})
+	for attempt := 0; attempt < 10; attempt++ {
+		policies, activePolicyNames, missing := cache.Resolve(loadBalancer)
+		var policyNames []string
+		for _, policy := range policies {
+			policyNames = append(policyNames, policy.PolicyName)
+		}
+		assert.Equal(t, []string{"app-sticky", "backend", "cookie", "sticky", "tls"}, policyNames, "resolved policy order")
+		assert.Len(t, activePolicyNames, 6, "active policy names")
+		assert.Equal(t, []string{"missing"}, missing, "missing policies")
+	}
+}
+
+// Without a grace period a load balancer with missing policies fails
+func TestHaproxyConfigurationHandlerMissingPolicy(t *testing.T) {
+	savedGrace := PendingLoadBalancerGrace
+	defer func() { PendingLoadBalancerGrace = savedGrace }()
+	PendingLoadBalancerGrace = 0
+	handler := &HaproxyConfigurationHandler{
+		func() (string, error) { return TemplateConf, nil },
+		func(string) error { return nil },
+		&HAproxyPolicyCache{Policies: map[string]ActivityPolicy{}},
+		NewAgentHealthState(),
+		NewAgentCheckServerGroup()}
+	err := handler.Send("set-loadbalancer", ExampleLoadBalancer)
+	assert.Error(t, err, "load balancer without policy")
+	assert.Equal(t, ActivityErrorMissingPolicy, ActivityErrorCategoryOf(err), "missing policy category")
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	// Version of the HAProxy state files
+	HaproxyStateVersion = 1
+
+	// State file for cached policies, in the state directory
+	HaproxyPoliciesStateFile = "haproxy-policies.state.json"
+
+	// State file for the last configured load balancer, in the state directory
+	HaproxyLoadBalancerStateFile = "haproxy-loadbalancer.state.json"
+)
+
+// Cached policies state file content
+type haproxyPoliciesState struct {
+	Version  int              `json:"version"`
+	Updated  string           `json:"updated"`
+	Policies []ActivityPolicy `json:"policies"`
+}
+
+// Last configured load balancer state file content
+type haproxyLoadBalancerState struct {
+	Version      int                   `json:"version"`
+	Updated      string                `json:"updated"`
+	LoadBalancer *ActivityLoadBalancer `json:"load_balancer"`
+}
+
+// Save the cached policies and last configured load balancer to the state
+// directory, if any. Must be called with the configuration mutex held.
+func (cache *HAproxyPolicyCache) saveState() {
+	if cache.StateDirectory == "" {
+		return
+	}
+	updated := time.Now().UTC().Format(time.RFC3339)
+	cache.mutex.RLock()
+	policiesState := &haproxyPoliciesState{Version: HaproxyStateVersion, Updated: updated}
+	for _, policy := range cache.Policies {
+		policiesState.Policies = append(policiesState.Policies, policy)
+	}
+	cache.mutex.RUnlock()
+	sort.Slice(policiesState.Policies, func(i, j int) bool {
+		return policiesState.Policies[i].PolicyName < policiesState.Policies[j].PolicyName
+	})
+	if err := writeStateFile(cache.statePath(HaproxyPoliciesStateFile), policiesState); err != nil {
+		logger.Printf("Error saving policies state %s\n", err.Error())
+	}
+	if cache.loadBalancer != nil {
+		loadBalancerState := &haproxyLoadBalancerState{
+			Version: HaproxyStateVersion, Updated: updated, LoadBalancer: cache.loadBalancer}
+		if err := writeStateFile(cache.statePath(HaproxyLoadBalancerStateFile), loadBalancerState); err != nil {
+			logger.Printf("Error saving load balancer state %s\n", err.Error())
+		}
+	}
+}
+
+// Load the cached policies and last configured load balancer from the state
+// directory. Missing state files are not an error, state from an invalid
+// state file is not loaded.
+func (cache *HAproxyPolicyCache) LoadState() error {
+	if cache.StateDirectory == "" {
+		return nil
+	}
+	configurationMutex.Lock()
+	defer configurationMutex.Unlock()
+	var errs []error
+	policiesState := &haproxyPoliciesState{}
+	loaded, err := readStateFile(cache.statePath(HaproxyPoliciesStateFile), policiesState, &policiesState.Version)
+	if err != nil {
+		errs = append(errs, err)
+	} else if loaded {
+		for _, policy := range policiesState.Policies {
+			cache.Put(policy)
+		}
+	}
+	loadBalancerState := &haproxyLoadBalancerState{}
+	loaded, err = readStateFile(cache.statePath(HaproxyLoadBalancerStateFile), loadBalancerState, &loadBalancerState.Version)
+	if err != nil {
+		errs = append(errs, err)
+	} else if loaded && loadBalancerState.LoadBalancer != nil {
+		cache.loadBalancer = loadBalancerState.LoadBalancer
+	}
+	return combineErrors(errs)
+}
+
+// Get the last configured load balancer, nil if none
+func (cache *HAproxyPolicyCache) LastLoadBalancer() *ActivityLoadBalancer {
+	configurationMutex.Lock()
+	defer configurationMutex.Unlock()
+	return cache.loadBalancer
+}
+
+func (cache *HAproxyPolicyCache) statePath(name string) string {
+	return fmt.Sprintf("%s/%s", cache.StateDirectory, name)
+}
+
+// Write a state file as JSON, the file is replaced so readers never see a
+// partial state
+func writeStateFile(path string, state interface{}) error {
+	stateJson, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err = ioutil.WriteFile(tempPath, append(stateJson, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// Read a state file, returns false if there is no state file
+// The version is checked after reading the state file.
+func readStateFile(path string, state interface{}, version *int) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(data, state); err != nil {
+		return false, errors.New(fmt.Sprintf("invalid state file %s: %s", path, err.Error()))
+	}
+	if *version != HaproxyStateVersion {
+		return false, errors.New(fmt.Sprintf("unsupported state file %s version %d", path, *version))
+	}
+	return true, nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Handler for tests with a cache saved to the given state directory
+func testStateConfigurationHandler(stateDirectory string, configurations chan string) *HaproxyConfigurationHandler {
+	handler := testPendingConfigurationHandler(configurations)
+	handler.Policies.StateDirectory = stateDirectory
+	return handler
+}
+
+func TestHaproxyStateRestore(t *testing.T) {
+	testRunDir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(testRunDir)
+	configurations := make(chan string, 2)
+	handler := testStateConfigurationHandler(testRunDir, configurations)
+	assert.NoError(t, handler.Send("set-policy", ExamplePolicy), "send policy")
+	assert.NoError(t, handler.Send("set-loadbalancer", ExampleLoadBalancer), "send load balancer")
+	configuration := <-configurations
+
+	restoredHandler := testStateConfigurationHandler(testRunDir, configurations)
+	assert.NoError(t, restoredHandler.Policies.LoadState(), "load state")
+	_, ok := restoredHandler.Policies.Get("sticky")
+	assert.True(t, ok, "restored policy")
+	loadBalancer := restoredHandler.Policies.LastLoadBalancer()
+	if assert.NotNil(t, loadBalancer, "restored load balancer") {
+		assert.Equal(t, "balancer-1", loadBalancer.LoadBalancerName, "restored load balancer name")
+		assert.Equal(t, "2020-04-02T16:18:19.451Z", loadBalancer.CreatedTime.String(), "restored created time")
+		assert.Len(t, loadBalancer.PolicyDescriptions, 0, "restored load balancer policies")
+	}
+	restored, err := restoredHandler.Restore()
+	assert.True(t, restored, "configuration restored")
+	assert.NoError(t, err, "restore configuration")
+	select {
+	case restoredConfiguration := <-configurations:
+		assert.Equal(t, configuration, restoredConfiguration, "restored configuration")
+	default:
+		t.Fatal("configuration not restored")
+	}
+}
+
+func TestHaproxyStateMissing(t *testing.T) {
+	testRunDir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(testRunDir)
+	handler := testStateConfigurationHandler(testRunDir, make(chan string, 1))
+	assert.NoError(t, handler.Policies.LoadState(), "load missing state")
+	restored, err := handler.Restore()
+	assert.False(t, restored, "configuration restored without state")
+	assert.NoError(t, err, "restore without state")
+}
+
+// State files with an unknown version are not loaded
+func TestHaproxyStateVersion(t *testing.T) {
+	testRunDir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(testRunDir)
+	policiesState := `{"version":2,"policies":[{"PolicyName":"sticky","PolicyTypeName":"LBCookieStickinessPolicyType"}]}`
+	err = ioutil.WriteFile(fmt.Sprintf("%s/%s", testRunDir, HaproxyPoliciesStateFile), []byte(policiesState), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = ioutil.WriteFile(fmt.Sprintf("%s/%s", testRunDir, HaproxyLoadBalancerStateFile), []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	handler := testStateConfigurationHandler(testRunDir, make(chan string, 1))
+	err = handler.Policies.LoadState()
+	assert.Error(t, err, "load unsupported state")
+	assert.Contains(t, err.Error(), "version 2", "unsupported version error")
+	assert.Contains(t, err.Error(), "invalid state file", "invalid state error")
+	_, ok := handler.Policies.Get("sticky")
+	assert.False(t, ok, "policy from unsupported state")
+	assert.Nil(t, handler.Policies.LastLoadBalancer(), "load balancer from invalid state")
+}
+
+func TestVerifyConfiguration(t *testing.T) {
+	assert.Error(t, VerifyConfiguration(TemplateConf), "template without frontends")
+	assert.Error(t, VerifyConfiguration("frontend"), "invalid configuration")
+	configuration, err := HaproxyConfigurationString(TemplateConf)
+	if err != nil {
+		t.Fatalf("HaproxyConfigurationString(TemplateConf) error; %s", err.Error())
+	}
+	assert.NoError(t, UpdateConfigurationServers(configuration, &ActivityLoadBalancer{
+		Listeners: []ActivityLoadBalancerListener{{Protocol: "HTTP", LoadBalancerPort: 8080, InstancePort: 8080}},
+	}, NewAgentHealthState(), NewAgentCheckServerGroup()), "update configuration")
+	assert.NoError(t, VerifyConfiguration(configuration.String()), "generated configuration")
+}
+
+// The agent regenerates the HAProxy configuration from saved state on start
+func TestRestoreLoadBalancer(t *testing.T) {
+	testRunDir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(testRunDir)
+	templatePath := fmt.Sprintf("%s/haproxy-template.conf", testRunDir)
+	if err = ioutil.WriteFile(templatePath, []byte(TemplateConf), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	handler := testStateConfigurationHandler(testRunDir, make(chan string, 1))
+	assert.NoError(t, handler.Send("set-policy", ExamplePolicy), "send policy")
+	withInstance := ExampleLoadBalancer[:len(ExampleLoadBalancer)-len("</member></LoadBalancerDescriptions>")] +
+		"<BackendInstances><member><InstanceId>i-00000001</InstanceId><InstanceIpAddress>10.111.10.216</InstanceIpAddress></member></BackendInstances>" +
+		"</member></LoadBalancerDescriptions>"
+	assert.NoError(t, handler.Send("set-loadbalancer", withInstance), "send load balancer")
+
+	lb := NewLoadBalancerContext("domain", "tasks", testRunDir, 0)
+	lb.ConfigurationTemplate = templatePath
+	restoreLoadBalancer(lb)
+	_, ok := lb.Policies.Get("sticky")
+	assert.True(t, ok, "restored policy")
+	assert.Len(t, lb.Health.InstanceStates(), 1, "restored instances")
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/loadbalancer-haproxy.conf", testRunDir))
+	if assert.NoError(t, err, "ReadFile(loadbalancer-haproxy.conf)") {
+		assert.Contains(t, string(data), "10.111.10.216:8080", "restored configuration server")
+	}
+}
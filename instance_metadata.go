@@ -0,0 +1,132 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Base URL for the instance metadata service
+	DefaultInstanceMetadataURL = "http://169.254.169.254/latest/meta-data/"
+
+	// Timeout for all instance metadata requests at startup
+	InstanceMetadataTimeout = 5 * time.Second
+
+	// Maximum size of an instance metadata value
+	instanceMetadataMaxBytes = 4096
+)
+
+// LocalInstance is the metadata for the instance running the agent, values
+// are empty when not available
+var LocalInstance = &InstanceMetadata{}
+
+// InstanceMetadata is the instance metadata used by the agent
+type InstanceMetadata struct {
+	InstanceId       string
+	LocalIpv4        string
+	AvailabilityZone string
+}
+
+// Client for the instance metadata service
+type InstanceMetadataClient struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// Create a client for the metadata service at the given base URL
+func NewInstanceMetadataClient(baseURL string) *InstanceMetadataClient {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL = baseURL + "/"
+	}
+	return &InstanceMetadataClient{
+		BaseURL: baseURL,
+		Client:  &http.Client{Timeout: InstanceMetadataTimeout},
+	}
+}
+
+// Get the instance metadata value for a path relative to the base URL
+func (client *InstanceMetadataClient) Get(ctx context.Context, path string) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, client.BaseURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := client.Client.Do(request.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, instanceMetadataMaxBytes))
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("instance metadata %s status %d", path, response.StatusCode))
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", errors.New(fmt.Sprintf("instance metadata %s empty", path))
+	}
+	return value, nil
+}
+
+// Fetch the instance metadata used by the agent
+// Values that could be read are returned with an error for the first value
+// that could not be read.
+func (client *InstanceMetadataClient) Fetch(ctx context.Context) (*InstanceMetadata, error) {
+	metadata := &InstanceMetadata{}
+	var firstErr error
+	for _, item := range []struct {
+		path  string
+		value *string
+	}{
+		{"instance-id", &metadata.InstanceId},
+		{"local-ipv4", &metadata.LocalIpv4},
+		{"placement/availability-zone", &metadata.AvailabilityZone},
+	} {
+		value, err := client.Get(ctx, item.path)
+		if err == nil && item.path == "local-ipv4" && net.ParseIP(value) == nil {
+			err = errors.New(fmt.Sprintf("instance metadata %s invalid address %s", item.path, value))
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		*item.value = value
+	}
+	return metadata, firstErr
+}
+
+// The SWF worker identity for the instance, empty if the instance is not known
+func (metadata *InstanceMetadata) Identity() string {
+	if metadata.InstanceId == "" {
+		return ""
+	}
+	if metadata.LocalIpv4 == "" {
+		return fmt.Sprintf("client-worker-%s", metadata.InstanceId)
+	}
+	return fmt.Sprintf("client-worker-%s@%s", metadata.InstanceId, metadata.LocalIpv4)
+}
+
+// The address to bind for a load balancer with the given scheme
+// Internal load balancers bind to the instance private address when known.
+func (metadata *InstanceMetadata) BindAddress(scheme string) string {
+	if strings.EqualFold(scheme, "internal") && metadata.LocalIpv4 != "" {
+		return metadata.LocalIpv4
+	}
+	return "0.0.0.0"
+}
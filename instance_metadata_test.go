@@ -0,0 +1,103 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"github.com/haproxytech/config-parser/v2"
+	"github.com/haproxytech/config-parser/v2/types"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Metadata service stand-in with the given values by path
+func testMetadataServer(values map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, ok := values[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(value))
+	}))
+}
+
+func TestInstanceMetadataFetch(t *testing.T) {
+	server := testMetadataServer(map[string]string{
+		"/latest/meta-data/instance-id":                 "i-0123456789abcdef0",
+		"/latest/meta-data/local-ipv4":                  "10.111.10.215\n",
+		"/latest/meta-data/placement/availability-zone": "one",
+	})
+	defer server.Close()
+	metadata, err := NewInstanceMetadataClient(server.URL + "/latest/meta-data").Fetch(context.Background())
+	assert.NoError(t, err, "fetch error")
+	assert.Equal(t, "i-0123456789abcdef0", metadata.InstanceId, "instance id")
+	assert.Equal(t, "10.111.10.215", metadata.LocalIpv4, "local ipv4")
+	assert.Equal(t, "one", metadata.AvailabilityZone, "availability zone")
+	assert.Equal(t, "client-worker-i-0123456789abcdef0@10.111.10.215", metadata.Identity(), "identity")
+}
+
+func TestInstanceMetadataFetchPartial(t *testing.T) {
+	server := testMetadataServer(map[string]string{
+		"/latest/meta-data/instance-id": "i-0123456789abcdef0",
+		"/latest/meta-data/local-ipv4":  "not-an-address",
+	})
+	defer server.Close()
+	metadata, err := NewInstanceMetadataClient(server.URL + "/latest/meta-data/").Fetch(context.Background())
+	assert.Error(t, err, "fetch error")
+	assert.Equal(t, "i-0123456789abcdef0", metadata.InstanceId, "instance id")
+	assert.Equal(t, "", metadata.LocalIpv4, "invalid local ipv4")
+	assert.Equal(t, "", metadata.AvailabilityZone, "missing availability zone")
+	assert.Equal(t, "client-worker-i-0123456789abcdef0", metadata.Identity(), "identity without address")
+}
+
+// An unresponsive metadata service must not block startup beyond the timeout
+func TestInstanceMetadataFetchTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	metadata, err := NewInstanceMetadataClient(server.URL).Fetch(ctx)
+	assert.Error(t, err, "fetch error")
+	assert.Equal(t, "", metadata.Identity(), "identity without instance id")
+	assert.True(t, time.Since(start) < 5*time.Second, "fetch time %s", time.Since(start))
+}
+
+func TestInstanceMetadataBindAddress(t *testing.T) {
+	metadata := &InstanceMetadata{LocalIpv4: "10.111.10.215"}
+	assert.Equal(t, "10.111.10.215", metadata.BindAddress("internal"), "internal bind address")
+	assert.Equal(t, "0.0.0.0", metadata.BindAddress("internet-facing"), "internet-facing bind address")
+	assert.Equal(t, "0.0.0.0", (&InstanceMetadata{}).BindAddress("internal"), "internal bind without metadata")
+
+	savedInstance := LocalInstance
+	defer func() { LocalInstance = savedInstance }()
+	LocalInstance = metadata
+	configuration, err := HaproxyConfigurationString(TemplateConf)
+	if err != nil {
+		t.Fatalf("HaproxyConfigurationString(TemplateConf) error; %s", err.Error())
+	}
+	err = UpdateConfiguration(configuration, &ActivityLoadBalancer{
+		Scheme:    "internal",
+		Listeners: []ActivityLoadBalancerListener{{Protocol: "HTTP", LoadBalancerPort: 8080, InstancePort: 8080}},
+	})
+	assert.NoError(t, err, "update configuration")
+	bind, err := configuration.Parser.Get(parser.Frontends, "http-8080", "bind")
+	if assert.NoError(t, err, "frontend bind") {
+		binds := bind.([]types.Bind)
+		if assert.Len(t, binds, 1, "frontend binds") {
+			assert.Equal(t, "10.111.10.215:8080", binds[0].Path, "internal frontend bind")
+		}
+	}
+}
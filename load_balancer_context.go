@@ -0,0 +1,223 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Agent-check ports reserved for each load balancer when there are
+// additional load balancers
+const AgentCheckPortsPerLoadBalancer = 100
+
+// DefaultLoadBalancer is the context for the load balancer served by the
+// -d domain and -l task list, using the agents global state
+var DefaultLoadBalancer = &LoadBalancerContext{
+	Primary:     true,
+	Health:      InstanceHealth,
+	AgentChecks: AgentCheckServers,
+	Policies:    PolicyCache,
+	PollBreaker: PollBreaker,
+}
+
+// LoadBalancerContext is the handler configuration and state for the load
+// balancer served by a (domain, task list) pair
+// Empty directory and configuration paths use the command line options. The
+// base handler is created by the ActivityHandlerFactory if there is no
+// handler factory for the context. HAProxy logs are not attributed to a
+// load balancer so access logs and metrics are for the primary context only.
+type LoadBalancerContext struct {
+	Domain                string
+	TaskList              string
+	Primary               bool
+	RunDirectory          string
+	ConfigurationTemplate string
+	ConfigurationOutput   string
+	HandlerFactory        func() (ActivityHandler, error)
+	Health                *AgentHealthState
+	AgentChecks           *AgentCheckServerGroup
+	Policies              *HAproxyPolicyCache
+	PollBreaker           *PollCircuitBreaker
+	valuesMutex           sync.Mutex
+	values                map[string]*activityValues
+}
+
+// Activity value cache state for an activity, guarded by the contexts
+// values mutex. Last part values are by part name.
+type activityValues struct {
+	valueFile      string
+	lastValue      string
+	lastPartValues map[string]string
+	valuesBySha1   map[string]CachedValue
+}
+
+// Create a context for an additional load balancer
+// The run directory holds activity values, configuration output and
+// agent-check overrides for the load balancer. Agent-check ports are
+// allocated from the base port, up to the ports reserved per load balancer.
+func NewLoadBalancerContext(domain string, taskList string, runDirectory string, agentCheckBasePort int) *LoadBalancerContext {
+	agentChecks := NewAgentCheckServerGroup()
+	if agentCheckBasePort > 0 {
+		agentChecks.BasePort = agentCheckBasePort
+		agentChecks.MaxPorts = AgentCheckPortsPerLoadBalancer
+	}
+	agentChecks.OverridesPath = fmt.Sprintf("%s/%s", runDirectory, "agent-check-overrides")
+	return &LoadBalancerContext{
+		Domain:       domain,
+		TaskList:     taskList,
+		RunDirectory: runDirectory,
+		Health:       NewAgentHealthState(),
+		AgentChecks:  agentChecks,
+		Policies: &HAproxyPolicyCache{
+			Policies:      map[string]ActivityPolicy{},
+			StatusSection: fmt.Sprintf("%s:%s:%s", StatusSectionConfiguration, domain, taskList),
+		},
+		PollBreaker: NewPollCircuitBreaker(fmt.Sprintf("%s:%s:%s", StatusSectionPolling, domain, taskList)),
+	}
+}
+
+// Parse a load balancer option of the form DOMAIN:TASK-LIST
+func ParseLoadBalancerOption(option string) (domain string, taskList string, err error) {
+	optionParts := strings.Split(option, ":")
+	if len(optionParts) != 2 || optionParts[0] == "" || optionParts[1] == "" {
+		return "", "", errors.New(fmt.Sprintf("invalid load balancer %s, expected DOMAIN:TASK-LIST", option))
+	}
+	return optionParts[0], optionParts[1], nil
+}
+
+// Check that the agent-check port ranges for the load balancers are valid
+// ports and do not overlap. A group without a port limit uses all ports
+// after the base port.
+func ValidateAgentCheckPorts(loadBalancers []*LoadBalancerContext) error {
+	type portRange struct {
+		lb          *LoadBalancerContext
+		first, last int
+	}
+	var ranges []portRange
+	for _, lb := range loadBalancers {
+		group := lb.AgentChecks
+		if group == nil || group.BasePort <= 0 {
+			continue
+		}
+		last := 65535
+		if group.MaxPorts > 0 {
+			last = group.BasePort + group.MaxPorts - 1
+		}
+		if last > 65535 {
+			return errors.New(fmt.Sprintf("agent-check ports %d-%d for %s out of range", group.BasePort, last, lb))
+		}
+		for _, other := range ranges {
+			if group.BasePort <= other.last && other.first <= last {
+				return errors.New(fmt.Sprintf("agent-check ports %d-%d for %s overlap ports %d-%d for %s",
+					group.BasePort, last, lb, other.first, other.last, other.lb))
+			}
+		}
+		ranges = append(ranges, portRange{lb, group.BasePort, last})
+	}
+	return nil
+}
+
+// Prefix for handler channel names, so load balancers sharing a handler
+// do not share values
+func (lb *LoadBalancerContext) ChannelPrefix() string {
+	return fmt.Sprintf("%s:%s:", lb.Domain, lb.TaskList)
+}
+
+// The run directory for the load balancer
+func (lb *LoadBalancerContext) runDirectory() string {
+	if lb.RunDirectory == "" {
+		return *runDir
+	}
+	return lb.RunDirectory
+}
+
+// Create the base handler for an activity
+func (lb *LoadBalancerContext) newHandler() (ActivityHandler, error) {
+	if lb.HandlerFactory != nil {
+		return lb.HandlerFactory()
+	}
+	return ActivityHandlerFactory()
+}
+
+// Create the HAProxy configuration handler for the load balancer, nil if
+// there is no configuration template
+func (lb *LoadBalancerContext) configurationHandler() *HaproxyConfigurationHandler {
+	configPath := lb.ConfigurationTemplate
+	if configPath == "" {
+		configPath = *configurationTemplate
+	}
+	if configPath == "" {
+		return nil
+	}
+	outputPath := lb.ConfigurationOutput
+	if outputPath == "" && lb.Primary {
+		outputPath = *configurationOutput
+	}
+	if outputPath == "" {
+		outputPath = fmt.Sprintf("%s/%s", lb.runDirectory(), "loadbalancer-haproxy.conf")
+	}
+	handler := NewHaproxyConfigurationHandler(configPath, outputPath).(*HaproxyConfigurationHandler)
+	handler.Policies = lb.Policies
+	handler.Health = lb.Health
+	handler.AgentChecks = lb.AgentChecks
+	return handler
+}
+
+// Get the value cache state for an activity, shared by all versions of the
+// activity. Must be called with the values mutex held.
+func (lb *LoadBalancerContext) activityValues(definition *ActivityDefinition) *activityValues {
+	if lb.values == nil {
+		lb.values = map[string]*activityValues{}
+	}
+	values, ok := lb.values[definition.Name]
+	if !ok {
+		values = &activityValues{
+			valueFile:      definition.ValueFile,
+			lastPartValues: map[string]string{},
+			valuesBySha1:   map[string]CachedValue{},
+		}
+		lb.values[definition.Name] = values
+	}
+	return values
+}
+
+// Forget the last part values with the given names and remove their value
+// files, used when policies are purged from the policy cache
+func (lb *LoadBalancerContext) purgeActivityPartValues(partNames []string) {
+	lb.valuesMutex.Lock()
+	defer lb.valuesMutex.Unlock()
+	for _, values := range lb.values {
+		for _, name := range partNames {
+			if _, ok := values.lastPartValues[name]; !ok {
+				continue
+			}
+			delete(values.lastPartValues, name)
+			if values.valueFile != "" {
+				removeActivityValue(lb.runDirectory(), activityPartValueFile(values.valueFile, name))
+			}
+		}
+	}
+}
+
+func (lb *LoadBalancerContext) String() string {
+	return fmt.Sprintf("domain:%s task-list:%s", lb.Domain, lb.TaskList)
+}
+
+// Flag value for repeated load balancer options
+type loadBalancerOptions []string
+
+func (options *loadBalancerOptions) String() string {
+	return strings.Join(*options, ",")
+}
+
+func (options *loadBalancerOptions) Set(value string) error {
+	if _, _, err := ParseLoadBalancerOption(value); err != nil {
+		return err
+	}
+	*options = append(*options, value)
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ActivityHandler that records sent values by name
+type recordingActivityHandler struct {
+	sent map[string]string
+}
+
+func (handler *recordingActivityHandler) Send(name string, value string) error {
+	handler.sent[name] = value
+	return nil
+}
+
+func (handler *recordingActivityHandler) Receive(name string) (*string, error) {
+	result := "result-" + name
+	return &result, nil
+}
+
+func (handler *recordingActivityHandler) Close() {
+}
+
+func TestParseLoadBalancerOption(t *testing.T) {
+	domain, taskList, err := ParseLoadBalancerOption("LoadbalancingDomain:lb-tasks")
+	assert.NoError(t, err, "parse option")
+	assert.Equal(t, "LoadbalancingDomain", domain, "domain")
+	assert.Equal(t, "lb-tasks", taskList, "task list")
+	for _, option := range []string{"", "domain", "domain:", ":tasks", "domain:tasks:extra"} {
+		_, _, err := ParseLoadBalancerOption(option)
+		assert.Error(t, err, fmt.Sprintf("parse invalid option %s", option))
+	}
+
+	var options loadBalancerOptions
+	assert.NoError(t, options.Set("domain:tasks-1"), "set option")
+	assert.NoError(t, options.Set("domain:tasks-2"), "set option")
+	assert.Error(t, options.Set("domain"), "set invalid option")
+	assert.Equal(t, "domain:tasks-1,domain:tasks-2", options.String(), "options")
+}
+
+func TestPrefixedHandler(t *testing.T) {
+	recorder := &recordingActivityHandler{sent: map[string]string{}}
+	handler := NewPrefixedHandler(recorder, "tasks:")
+	assert.NoError(t, handler.Send("set-policy", "policy"), "send")
+	assert.Equal(t, "policy", recorder.sent["tasks:set-policy"], "prefixed send")
+	result, err := handler.Receive("get-instance-status")
+	assert.NoError(t, err, "receive")
+	assert.Equal(t, "result-tasks:get-instance-status", value(result), "prefixed receive")
+}
+
+// Load balancers polled by the same agent do not share values or state
+func TestLoadBalancerContextIsolation(t *testing.T) {
+	savedFactory := ActivityHandlerFactory
+	defer func() { ActivityHandlerFactory = savedFactory }()
+	ActivityHandlerFactory = func() (ActivityHandler, error) {
+		return &fakeActivityHandler{time.Millisecond}, nil
+	}
+
+	var loadBalancers []*LoadBalancerContext
+	for index := 1; index <= 2; index++ {
+		testRunDir, err := ioutil.TempDir("", "run")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer os.RemoveAll(testRunDir)
+		loadBalancers = append(loadBalancers,
+			NewLoadBalancerContext("domain", fmt.Sprintf("tasks-%d", index), testRunDir, 0))
+	}
+	first, second := loadBalancers[0], loadBalancers[1]
+	assert.NotSame(t, first.PollBreaker, second.PollBreaker, "poll circuit breakers")
+
+	loadBalancer, policy := ExampleLoadBalancer, ExamplePolicy
+	firstClient := newFakeSwfClient([]*SwfActivityTask{
+		activityTask("policy", "LoadBalancingVmActivities.setPolicy", &policy),
+		activityTask("loadbalancer", "LoadBalancingVmActivities.setLoadBalancer", &loadBalancer),
+	})
+	for firstClient.remaining() > 0 {
+		assert.NoError(t, pollActivityTask(context.Background(), firstClient, first), "poll first")
+	}
+	assert.Equal(t, 2, len(firstClient.completed), "first completed tasks")
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/loadbalancer.xml", first.RunDirectory))
+	assert.NoError(t, err, "ReadFile(first loadbalancer.xml)")
+	assert.Equal(t, ExampleLoadBalancer, string(data), "first loadbalancer.xml")
+	_, err = os.Stat(fmt.Sprintf("%s/loadbalancer.xml", second.RunDirectory))
+	assert.True(t, os.IsNotExist(err), "second loadbalancer.xml not stored")
+
+	// A policy hash is only resolved by the load balancer that received the policy
+	policySha1 := sha1.Sum([]byte(ExamplePolicy))
+	policyHash := hex.EncodeToString(policySha1[:])
+	secondClient := newFakeSwfClient([]*SwfActivityTask{
+		activityTask("policy", "LoadBalancingVmActivities.setPolicy", &policyHash),
+	})
+	assert.NoError(t, pollActivityTask(context.Background(), secondClient, second), "poll second")
+
+	activity, _ := Activities.Get("LoadBalancingVmActivities.setPolicy")
+	first.valuesMutex.Lock()
+	assert.Equal(t, ExamplePolicy, activityValueCache(activity, first.activityValues(activity), policyHash), "first policy cache")
+	first.valuesMutex.Unlock()
+	second.valuesMutex.Lock()
+	assert.Equal(t, "", second.activityValues(activity).lastValue, "second policy value")
+	assert.Equal(t, 0, len(second.activityValues(activity).valuesBySha1), "second policy cache")
+	second.valuesMutex.Unlock()
+}
+
+func TestLoadBalancerContextChannelPrefix(t *testing.T) {
+	first := NewLoadBalancerContext("domain-1", "tasks", "", 0)
+	second := NewLoadBalancerContext("domain-2", "tasks", "", 0)
+	assert.Equal(t, "domain-1:tasks:", first.ChannelPrefix(), "channel prefix")
+	assert.NotEqual(t, first.ChannelPrefix(), second.ChannelPrefix(), "prefix for task list in other domain")
+}
+
+func TestValidateAgentCheckPorts(t *testing.T) {
+	primary := &LoadBalancerContext{Domain: "domain", TaskList: "tasks-1", AgentChecks: NewAgentCheckServerGroup()}
+	primary.AgentChecks.BasePort = 9000
+	second := NewLoadBalancerContext("domain", "tasks-2", "", 9000+AgentCheckPortsPerLoadBalancer)
+	assert.Error(t, ValidateAgentCheckPorts([]*LoadBalancerContext{primary, second}), "unlimited primary overlaps")
+	primary.AgentChecks.MaxPorts = AgentCheckPortsPerLoadBalancer
+	assert.NoError(t, ValidateAgentCheckPorts([]*LoadBalancerContext{primary, second}), "adjacent ranges")
+	third := NewLoadBalancerContext("domain", "tasks-3", "", 9050)
+	assert.Error(t, ValidateAgentCheckPorts([]*LoadBalancerContext{primary, second, third}), "overlapping ranges")
+	last := NewLoadBalancerContext("domain", "tasks-4", "", 65500)
+	assert.Error(t, ValidateAgentCheckPorts([]*LoadBalancerContext{last}), "range beyond last port")
+	disabled := NewLoadBalancerContext("domain", "tasks-5", "", 0)
+	assert.NoError(t, ValidateAgentCheckPorts([]*LoadBalancerContext{primary, disabled}), "disabled agent-check")
+
+	group := NewAgentCheckServerGroup()
+	group.BasePort, group.MaxPorts = 9000, 1
+	assert.Error(t, group.Configure(NewAgentHealthState(), []string{"backend-http-80", "backend-http-81"}),
+		"configure more backends than ports")
+	assert.Empty(t, group.Servers, "no responders when ports exhausted")
+}
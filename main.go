@@ -4,13 +4,21 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -20,6 +28,9 @@ const (
 
 	// Cache time for activity values, from last access
 	ActivityCacheSeconds = 300
+
+	// Interval for activity heartbeats when there is no heartbeat timeout
+	DefaultHeartbeatInterval = 30 * time.Second
 )
 
 // ActivityHandler handles in/out values for workflow activities.
@@ -43,55 +54,49 @@ var (
 	// Logger for the application
 	logger *log.Logger
 
-	// ActivityChannels maps workflow activity names to handler identifiers
-	ActivityChannels = map[string]string{
-		"LoadBalancingVmActivities.getCloudWatchMetrics": "get-cloudwatch-metrics",
-		"LoadBalancingVmActivities.getInstanceStatus":    "get-instance-status",
-		"LoadBalancingVmActivities.setLoadBalancer":      "set-loadbalancer",
-		"LoadBalancingVmActivities.setPolicy":            "set-policy",
-	}
-
-	// ActivityDefaultValues maps workflow activity names to default values.
-	// A workflow activity that has no value is an out only activity and the
-	// default value will be sent.
-	ActivityDefaultValues = map[string]string{
-		"LoadBalancingVmActivities.getCloudWatchMetrics": "GetCloudWatchMetrics",
-		"LoadBalancingVmActivities.getInstanceStatus":    "GetInstanceStatus",
-	}
-
-	// ActivityLastValues tracks the last sent value by workflow activity name.
-	// BUG(s): There can be multiple policies so tracking the last one is odd
-	ActivityLastValues = map[string]string{
-		"LoadBalancingVmActivities.setLoadBalancer": "",
-		"LoadBalancingVmActivities.setPolicy":       "",
-	}
-
-	// ActivityValuesBySha1 maps values by SHA-1 key by workflow activity name.
-	// Keys are the hex string for the values UTF-8 SHA-1 hash.
-	ActivityValuesBySha1 = map[string]map[string]CachedValue{
-		"LoadBalancingVmActivities.setLoadBalancer": {},
-		"LoadBalancingVmActivities.setPolicy":       {},
-	}
+	// ActivityHandlerFactory creates the base handler for each activity
+	ActivityHandlerFactory = NewRedisHandler
 )
 
 // Command line interface options
 var (
-	endpoint = flag.String("e", "", "SWF Service Endpoint")
-	domain   = flag.String("d", "", "SWF Domain")
-	tasklist = flag.String("l", "", "SWF task list")
-
-	_ = flag.Int("o", 30, "SWF client connection timeout")
-	_ = flag.Int("m", 1, "SWF client max connections")
-	_ = flag.Int("r", 1, "SWF domain retention period in days")
-	_ = flag.Int("t", 1, "Polling threads count (ignored)")
+	endpoint    = flag.String("e", "", "SWF Service Endpoint")
+	metadataURL = flag.String("M", DefaultInstanceMetadataURL, "Instance metadata service URL (empty to disable)")
+	s3Endpoint  = flag.String("s", "", "S3 (object storage) Service Endpoint for access logs")
+	cwEndpoint  = flag.String("w", "", "CloudWatch Service Endpoint for direct metrics publishing")
+	domain      = flag.String("d", "", "SWF Domain")
+	tasklist    = flag.String("l", "", "SWF task list")
+
+	credentialsPath = flag.String("c", "", "Servo credentials file for TLS trust and certificate decryption")
+	pinCloudCA      = flag.Bool("P", false, "Trust only the Eucalyptus CA for TLS endpoints")
+	verifyPayloads  = flag.Bool("V", false, "Verify signed activity payloads")
+	strictPayloads  = flag.Bool("S", false, "Require signed activity payloads (implies -V)")
+
+	connectTimeout   = flag.Int("o", 30, "SWF client connection timeout")
+	maxConnections   = flag.Int("m", 1, "SWF client max connections")
+	pollTimeout      = flag.Int("p", 70, "SWF client poll timeout")
+	responseTimeout  = flag.Int("q", 30, "SWF client response timeout")
+	retentionDays    = flag.Int("r", 1, "SWF domain retention period in days")
+	pollers          = flag.Int("t", 1, "Polling threads count")
+	shutdownTimeout  = flag.Int("D", 30, "Shutdown deadline for in-flight activities")
+	heartbeatTimeout = flag.Int("H", 0, "SWF activity heartbeat timeout for activities without a timeout (0 for none)")
+	activityVersions = flag.String("A", "", "Activity versions file for additional activity registrations")
 
 	configurationTemplate = flag.String("T", "", "HAProxy configuration template path")
 	configurationOutput   = flag.String("O", "", "HAProxy configuration output path")
+	agentCheckPort        = flag.Int("a", 0, "HAProxy agent-check base port (0 to disable)")
+	policyGrace           = flag.Int("g", 60, "Grace period for a load balancer waiting for policies (0 to fail)")
 
 	runDir = flag.String("R", "/var/run/load-balancer-servo", "Directory containing runtime files")
 	logDir = flag.String("L", "/var/log/load-balancer-servo", "Directory containing log files")
+
+	additionalLoadBalancers loadBalancerOptions
 )
 
+func init() {
+	flag.Var(&additionalLoadBalancers, "b", "Additional load balancer DOMAIN:TASK-LIST to poll (repeatable)")
+}
+
 func main() {
 	flag.Parse()
 
@@ -107,11 +112,6 @@ func main() {
 		*configDomain = "LoadbalancingDomain"
 	}
 
-	configTaskList := tasklist
-	if *configTaskList == "" {
-		*configTaskList = "i-00000000"
-	}
-
 	logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
 	logFile, err := os.Create(fmt.Sprintf("%s/load-balancer-workflow.log", *logDir))
 	if err == nil {
@@ -120,19 +120,201 @@ func main() {
 		logger.Printf("Log file error %s\n", err.Error())
 	}
 
+	if *metadataURL != "" {
+		LocalInstance = loadInstanceMetadata(*metadataURL)
+	}
+	Metrics.AvailabilityZone = LocalInstance.AvailabilityZone
+
+	configTaskList := tasklist
+	if *configTaskList == "" {
+		*configTaskList = LocalInstance.InstanceId
+	}
+	if *configTaskList == "" {
+		*configTaskList = "i-00000000"
+	}
+
 	logger.Printf("Using domain:%s task-list:%s endpoint:%s\n", *configDomain, *configTaskList, *configEndpoint)
 
-	client, err := NewSwfClient(*configEndpoint, EucalyptusRegion)
+	if *credentialsPath != "" {
+		logger.Printf("Using credentials file %s\n", *credentialsPath)
+		ServoCredentials = watchCredentials(*credentialsPath, *pinCloudCA)
+	}
+
+	if *activityVersions != "" {
+		if err := Activities.RegisterVersionsFile(*activityVersions); err != nil {
+			logger.Fatalf("Error registering activity versions %s\n", err.Error())
+		}
+		logger.Printf("Using activity versions from %s\n", *activityVersions)
+	}
+
+	ActivityVerifier.Enabled = *verifyPayloads
+	ActivityVerifier.Strict = *strictPayloads
+
+	Status.Path = fmt.Sprintf("%s/%s", *runDir, "load-balancer-agent.status")
+
+	PendingLoadBalancerGrace = seconds(int64(*policyGrace))
+	AgentCheckServers.BasePort = *agentCheckPort
+	AgentCheckServers.OverridesPath = fmt.Sprintf("%s/%s", *runDir, "agent-check-overrides")
+
+	DefaultLoadBalancer.Domain = *configDomain
+	DefaultLoadBalancer.TaskList = *configTaskList
+	loadBalancers := []*LoadBalancerContext{DefaultLoadBalancer}
+	for index, option := range additionalLoadBalancers {
+		lbDomain, lbTaskList, _ := ParseLoadBalancerOption(option)
+		lbRunDir := fmt.Sprintf("%s/%s-%s", *runDir, lbDomain, lbTaskList)
+		if err := os.MkdirAll(lbRunDir, 0755); err != nil {
+			logger.Fatalf("Error creating load balancer directory %s\n", err.Error())
+		}
+		lbAgentCheckPort := 0
+		if *agentCheckPort > 0 {
+			lbAgentCheckPort = *agentCheckPort + (index+1)*AgentCheckPortsPerLoadBalancer
+		}
+		lb := NewLoadBalancerContext(lbDomain, lbTaskList, lbRunDir, lbAgentCheckPort)
+		lbPrefix := lb.ChannelPrefix()
+		lb.HandlerFactory = func() (ActivityHandler, error) {
+			handler, err := ActivityHandlerFactory()
+			if err != nil {
+				return nil, err
+			}
+			return NewPrefixedHandler(handler, lbPrefix), nil
+		}
+		logger.Printf("Using additional load balancer %s run-dir:%s\n", lb, lbRunDir)
+		loadBalancers = append(loadBalancers, lb)
+	}
+	if len(loadBalancers) > 1 {
+		AgentCheckServers.MaxPorts = AgentCheckPortsPerLoadBalancer
+	}
+	if err := ValidateAgentCheckPorts(loadBalancers); err != nil {
+		logger.Fatalf("Error configuring load balancers %s\n", err.Error())
+	}
+	for _, lb := range loadBalancers {
+		lb.Policies.OnPurge = lb.purgeActivityPartValues
+		restoreLoadBalancer(lb)
+		Status.Set(lb.PollBreaker.StatusSection, lb.PollBreaker.Status())
+	}
+
+	AccessLogs.Directory = *logDir
+	AccessLogs.Address = LocalAddress()
+	configS3Endpoint := s3Endpoint
+	if *configS3Endpoint == "" {
+		*configS3Endpoint = "http://objectstorage.internal:8773"
+	}
+	uploader := NewAccessLogUploader(nil, AccessLogs.SpoolDirectory())
+	AccessLogs.Rotated = uploader.Notify
+	go uploader.RunWithClient(func() (s3iface.S3API, error) {
+		return NewS3Client(*configS3Endpoint, EucalyptusRegion)
+	})
+	logConsumers := []func(*HaproxyLogRecord){func(record *HaproxyLogRecord) {
+		if err := AccessLogs.Write(record, time.Now()); err != nil {
+			logger.Printf("Error writing access log %s\n", err.Error())
+		}
+	}}
+	if *cwEndpoint != "" {
+		cloudWatchClient, err := NewCloudWatchClient(*cwEndpoint, EucalyptusRegion)
+		if err != nil {
+			logger.Fatalf("Error creating metrics client %s\n", err.Error())
+		}
+		logger.Printf("Publishing metrics to endpoint:%s\n", *cwEndpoint)
+		logConsumers = append(logConsumers, Metrics.Record)
+		MetricsPublishedDirectly = true
+		go NewCloudWatchPublisher(cloudWatchClient, Metrics, InstanceHealth).Run()
+	}
+	logListener, err := NewHaproxyLogListener(HaproxyLogSocket, logConsumers...)
 	if err != nil {
-		logger.Fatalf("Error creating client %s\n", err.Error())
+		logger.Printf("Error listening for HAProxy logs %s\n", err.Error())
+	} else {
+		go logListener.Serve()
+		defer logListener.Close()
 	}
+	go maintainAccessLogs()
 
-	err = client.RegisterActivities(configDomain)
+	pollCount := *pollers
+	if pollCount < 1 {
+		pollCount = 1
+	}
+	configMaxConnections := *maxConnections
+	if totalPollers := pollCount * len(loadBalancers); configMaxConnections < totalPollers {
+		logger.Printf("SWF client max connections %d less than polling threads %d, using %d\n",
+			configMaxConnections, totalPollers, totalPollers)
+		configMaxConnections = totalPollers
+	}
+	configPollTimeout := *pollTimeout
+	if configPollTimeout <= SwfLongPollSeconds {
+		logger.Printf("SWF client poll timeout %d not greater than long poll %d, using %d\n",
+			configPollTimeout, SwfLongPollSeconds, SwfLongPollSeconds+10)
+		configPollTimeout = SwfLongPollSeconds + 10
+	}
+	client, err := NewSwfClient(*configEndpoint, EucalyptusRegion, SwfClientConfig{
+		ConnectTimeout:   seconds(int64(*connectTimeout)),
+		MaxConnections:   configMaxConnections,
+		PollTimeout:      seconds(int64(configPollTimeout)),
+		ResponseTimeout:  seconds(int64(*responseTimeout)),
+		HeartbeatTimeout: seconds(int64(*heartbeatTimeout)),
+		Identity:         LocalInstance.Identity(),
+	})
 	if err != nil {
-		logger.Fatalf("Error registering activities %s\n", err.Error())
+		logger.Fatalf("Error creating client %s\n", err.Error())
+	}
+
+	registeredDomains := map[string]bool{}
+	for _, lb := range loadBalancers {
+		if registeredDomains[lb.Domain] {
+			continue
+		}
+		registeredDomains[lb.Domain] = true
+		err = client.RegisterDomain(aws.String(lb.Domain), *retentionDays)
+		if err != nil {
+			logger.Fatalf("Error registering domain %s\n", err.Error())
+		}
+
+		err = client.RegisterActivities(aws.String(lb.Domain))
+		if err != nil {
+			logger.Fatalf("Error registering activities %s\n", err.Error())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		received := <-signals
+		logger.Printf("Received signal %s, shutting down\n", received)
+		cancel()
+	}()
+
+	var pollersGroup sync.WaitGroup
+	for _, lb := range loadBalancers {
+		for poller := 0; poller < pollCount; poller++ {
+			pollersGroup.Add(1)
+			go func(lb *LoadBalancerContext) {
+				defer pollersGroup.Done()
+				pollActivityTasks(ctx, client, lb)
+			}(lb)
+		}
 	}
+	pollersGroup.Wait()
 
-	pollActivityTasks(client, configDomain, configTaskList)
+	for _, lb := range loadBalancers {
+		lb.Policies.StopPending()
+		lb.AgentChecks.Close()
+	}
+	if err = AccessLogs.Close(time.Now()); err != nil {
+		logger.Printf("Error closing access log %s\n", err.Error())
+	}
+	logger.Println("Shutdown complete")
+	if logFile != nil {
+		_ = logFile.Sync()
+	}
+}
+
+// Rotate access logs at the end of each emit interval
+// Rotation also occurs on write, this handles intervals without traffic.
+func maintainAccessLogs() {
+	for timeNow := range time.Tick(10 * time.Second) {
+		if err := AccessLogs.Maintain(timeNow); err != nil {
+			logger.Printf("Error rotating access log %s\n", err.Error())
+		}
+	}
 }
 
 // The string value or "<<none>>" if nil
@@ -146,74 +328,278 @@ func value(text *string) string {
 
 // Task polling loop for activity handling.
 // Polls for tasks and handles as they are available using swf long polling.
+// Multiple polling loops can run concurrently. The loop returns when the
+// context is done and any in-flight activity has completed.
+func pollActivityTasks(ctx context.Context, client SwfActivityClient, lb *LoadBalancerContext) {
+	logger.Printf("Polling for tasks %s\n", lb)
+	for ctx.Err() == nil {
+		delay := pollActivityTaskWithBackoff(ctx, lb.PollBreaker, client, lb)
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+		}
+	}
+	logger.Println("Polling stopped")
+}
+
+// Poll for and handle a single activity task using the circuit breaker
+// Returns the delay before the next poll.
+func pollActivityTaskWithBackoff(ctx context.Context, breaker *PollCircuitBreaker, client SwfActivityClient, lb *LoadBalancerContext) time.Duration {
+	if delay := breaker.BeforePoll(); delay > 0 {
+		return delay
+	}
+	err := pollActivityTask(ctx, client, lb)
+	if err != nil {
+		return breaker.Failure(err)
+	}
+	breaker.Success()
+	return 0
+}
+
+// Poll for and handle a single activity task for a load balancer
+// Returns an error only if polling fails. A poll abandoned because the
+// context is done is not an error.
 //
 // Polling can time out without a task being available, in which case the
 // token will be nil.
-func pollActivityTasks(client SwfActivityClient, domain *string, taskList *string) {
-	logger.Println("Polling for tasks")
-	for {
-		activityTask, err := client.PollTasks(domain, taskList)
-		if err == nil {
-			if activityTask.Token != nil {
-				taskToken := activityTask.Token
-				taskActivity := activityTask.Name
-				taskParam := activityTask.Parameter
-				logger.Printf("Handling activity task %s parameter %s\n", *taskActivity, value(taskParam))
-				activityResult, err := doActivity(*taskActivity, taskParam)
-				if err == nil {
-					logger.Printf("Handled activity task %s with result %s\n", *taskActivity, value(activityResult))
-					err = client.RespondTaskComplete(*taskToken, activityResult)
-					if err != nil {
-						logger.Printf("Error responding activity task completed %s\n", err.Error())
-					}
-				}
+func pollActivityTask(ctx context.Context, client SwfActivityClient, lb *LoadBalancerContext) error {
+	activityTask, err := client.PollTasks(ctx, aws.String(lb.Domain), aws.String(lb.TaskList))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	if activityTask.Token == nil {
+		logger.Println("Polling for tasks")
+		return nil
+	}
+	taskToken := activityTask.Token
+	inputErr := activityTask.InputError
+	var definition *ActivityDefinition
+	if inputErr == nil {
+		var ok bool
+		definition, ok = Activities.Lookup(*activityTask.Name, aws.StringValue(activityTask.Version))
+		if !ok {
+			inputErr = errors.New(fmt.Sprintf("unknown activity %s version %s",
+				*activityTask.Name, aws.StringValue(activityTask.Version)))
+		}
+	}
+	var taskSignature *string
+	if inputErr == nil && definition.SignatureArgument > 0 && activityTask.Input != nil {
+		taskSignature, inputErr = activityTask.Input.StringArgument(definition.SignatureArgument)
+	}
+	if inputErr != nil {
+		logger.Printf("Responding activity task failed (%s) for input %s\n", ActivityErrorInvalidInput, inputErr.Error())
+		err = client.RespondTaskFailed(*taskToken, NewActivityError(ActivityErrorInvalidInput, inputErr))
+		if err != nil {
+			logger.Printf("Error responding activity task failed %s\n", err.Error())
+		}
+		return nil
+	}
+	taskActivity := activityTask.Name
+	taskParam := activityTask.Parameter
+	logger.Printf("Handling activity task %s %s parameter %s\n", *taskActivity, definition.Version, value(taskParam))
+	activityCtx, cancel := activityContext(ctx, seconds(int64(*shutdownTimeout)))
+	defer cancel()
+	heartbeatInterval := activityHeartbeatInterval(definition.ResolveHeartbeatTimeout(seconds(int64(*heartbeatTimeout))))
+	stopHeartbeat := startActivityHeartbeat(client, *taskToken, heartbeatInterval, cancel)
+	activityResult, err := doActivity(activityCtx, lb, definition, taskParam, taskSignature)
+	if stopHeartbeat() {
+		logger.Printf("Responding activity task %s canceled\n", *taskActivity)
+		err = client.RespondTaskCanceled(*taskToken, "activity canceled on request")
+		if err != nil {
+			logger.Printf("Error responding activity task canceled %s\n", err.Error())
+		}
+		return nil
+	}
+	if err == nil {
+		logger.Printf("Handled activity task %s with result %s\n", *taskActivity, value(activityResult))
+		err = client.RespondTaskComplete(*taskToken, activityResult)
+		if err != nil {
+			logger.Printf("Error responding activity task completed %s\n", err.Error())
+		}
+	}
+	if err != nil {
+		logger.Printf("Responding activity task failed (%s) %s\n", ActivityErrorCategoryOf(err), err.Error())
+		err = client.RespondTaskFailed(*taskToken, err)
+		if err != nil {
+			logger.Printf("Error responding activity task failed %s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+// Watch the credentials file, new credentials are used for server
+// certificate decryption and the Eucalyptus CA from the credentials is
+// trusted for TLS endpoints
+func watchCredentials(credentialsPath string, pinned bool) *CredentialsWatcher {
+	watcher := NewCredentialsWatcher(credentialsPath)
+	if _, err := watcher.Check(time.Now()); err != nil {
+		logger.Printf("ERROR Invalid credentials file %s: %s\n", credentialsPath, err.Error())
+	}
+	watcher.AddListener(func(_ Credentials, values *CredentialValues) {
+		if expiry := values.Expiry(); !expiry.IsZero() {
+			logger.Printf("Credentials certificates expire at %s\n", expiry.UTC().Format(time.RFC3339))
+		}
+		if values.EucalyptusCertificate == nil {
+			logger.Println("No Eucalyptus certificate in credentials, using system roots for TLS trust")
+			CloudTLSTrust.Set(nil)
+			return
+		}
+		logger.Printf("Trusting Eucalyptus certificate %s for TLS (pinned %t)\n",
+			values.EucalyptusCertificate.Subject, pinned)
+		CloudTLSTrust.Set(NewCloudTLSConfig(values.EucalyptusCertificate, pinned))
+	})
+	watcher.AddListener(ServerCertificateDecryption.SetCredentials)
+	go watcher.Run()
+	return watcher
+}
+
+// Load the instance metadata from the metadata service
+// Metadata that is not available is logged and left empty so the agent
+// falls back to configured or default values.
+func loadInstanceMetadata(baseURL string) *InstanceMetadata {
+	ctx, cancel := context.WithTimeout(context.Background(), InstanceMetadataTimeout)
+	defer cancel()
+	metadata, err := NewInstanceMetadataClient(baseURL).Fetch(ctx)
+	if err != nil {
+		logger.Printf("WARNING Instance metadata not available %s\n", err.Error())
+	}
+	logger.Printf("Using instance-id:%s local-ipv4:%s availability-zone:%s\n",
+		metadata.InstanceId, metadata.LocalIpv4, metadata.AvailabilityZone)
+	return metadata
+}
+
+// Interval for activity heartbeats with the given heartbeat timeout
+// Heartbeats are recorded three times per heartbeat timeout so a single
+// failed heartbeat does not time out the task.
+func activityHeartbeatInterval(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultHeartbeatInterval
+	}
+	interval := timeout / 3
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// Record heartbeats for an activity task until the returned stop function
+// is called. The activity is canceled via the given function if the task
+// cancellation is requested, stop returns true in that case.
+func startActivityHeartbeat(client SwfActivityClient, token string, interval time.Duration, cancel context.CancelFunc) (stop func() bool) {
+	stopped := make(chan struct{})
+	cancelRequested := make(chan struct{})
+	var heartbeats sync.WaitGroup
+	heartbeats.Add(1)
+	go func() {
+		defer heartbeats.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-ticker.C:
+				requested, err := client.RecordHeartbeat(token)
 				if err != nil {
-					logger.Printf("Responding activity task failed %s\n", err.Error())
-					failureMessage := err.Error()
-					err = client.RespondTaskFailed(*taskToken, failureMessage)
-					if err != nil {
-						logger.Printf("Error responding activity task failed %s\n", err.Error())
-					}
+					logger.Printf("Error recording activity heartbeat %s\n", err.Error())
+				} else if requested {
+					logger.Println("Activity task cancellation requested, aborting activity")
+					close(cancelRequested)
+					cancel()
+					return
 				}
-			} else {
-				logger.Println("Polling for tasks")
 			}
 		}
+	}()
+	return func() bool {
+		close(stopped)
+		heartbeats.Wait()
+		select {
+		case <-cancelRequested:
+			return true
+		default:
+			return false
+		}
 	}
 }
 
+// Context for an activity that is done the given deadline after the
+// polling context is done, so in-flight activities can complete on shutdown.
+func activityContext(pollCtx context.Context, deadline time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-pollCtx.Done():
+			select {
+			case <-time.After(deadline):
+				logger.Println("Shutdown deadline reached, aborting activity")
+				cancel()
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 // Handle an activity task with optional parameter
 // Responsible for managing the activity value cache and handler lifecycle.
-func doActivity(activity string, parameter *string) (*string, error) {
-	var value string
+// The handler is closed to abort the activity if the context is done.
+func doActivity(ctx context.Context, lb *LoadBalancerContext, definition *ActivityDefinition, parameter *string,
+	signature *string) (*string, error) {
+	if definition.DirectResult != nil {
+		if result, ok := definition.DirectResult(); ok {
+			return &result, nil
+		}
+	}
+	value := definition.DefaultValue
 	if parameter != nil {
 		value = *parameter
-	} else {
-		value = ActivityDefaultValues[activity]
 	}
-	if lastValue, ok := ActivityLastValues[activity]; ok {
-		value = activityValueCache(activity, value)
-		if value != lastValue {
-			ActivityLastValues[activity] = value
-			storeActivityValue(ActivityChannels[activity][4:], value)
-		}
+	var err error
+	if definition.Cached {
+		value, err = activityValueUpdate(lb, definition, value, signature)
+	} else if parameter != nil {
+		err = ActivityVerifier.Verify(definition, parameter, signature)
+	}
+	if err != nil {
+		logger.Printf("Error verifying value for %s %s\n", definition.Name, err.Error())
+		return nil, err
 	}
 
-	redisHandler, err := NewRedisHandler()
+	baseHandler, err := lb.newHandler()
 	if err != nil {
 		logger.Printf("Error creating handler %s\n", err.Error())
 		return nil, err
 	}
-	defer redisHandler.Close()
-	handler := configurationOutputEnhance(redisHandler)
+	defer baseHandler.Close()
+	handlerDone := make(chan struct{})
+	defer close(handlerDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			baseHandler.Close()
+		case <-handlerDone:
+		}
+	}()
+	handler := configurationOutputEnhance(lb, baseHandler)
 
-	err = handler.Send(ActivityChannels[activity], value)
+	err = handler.Send(definition.Channel, value)
 	if err != nil {
 		logger.Printf("Error sending to handler %s\n", err.Error())
 		return nil, err
 	}
-	if parameter == nil {
-		result, err := handler.Receive(ActivityChannels[activity])
+	if definition.Direction == ActivityOut {
+		result, err := handler.Receive(definition.Channel)
+		if err != nil && ctx.Err() != nil {
+			err = NewActivityError(ActivityErrorTransient,
+				errors.New(fmt.Sprintf("activity aborted %s", ctx.Err().Error())))
+		}
 		if err != nil {
 			logger.Printf("Error receiving from handler %s\n", err.Error())
 			return nil, err
@@ -224,10 +610,70 @@ func doActivity(activity string, parameter *string) (*string, error) {
 	return nil, nil
 }
 
+// Resolve an activity value using the cache and track the last value.
+// The signature is verified for the resolved value, a value that fails
+// verification is not cached. A changed value is stored to disk. Values are
+// updated under lock so concurrent activities see a consistent cache and
+// last value.
+func activityValueUpdate(lb *LoadBalancerContext, definition *ActivityDefinition, value string,
+	signature *string) (string, error) {
+	lb.valuesMutex.Lock()
+	defer lb.valuesMutex.Unlock()
+	values := lb.activityValues(definition)
+	if resolved, _ := activityValueResolve(values, value); resolved != "" {
+		if err := ActivityVerifier.Verify(definition, &resolved, signature); err != nil {
+			return "", err
+		}
+	}
+	value = activityValueCache(definition, values, value)
+	if value == values.lastValue {
+		return value, nil
+	}
+	values.lastValue = value
+	if definition.ValueFile != "" {
+		storeActivityValue(lb.runDirectory(), definition.ValueFile, value)
+	}
+	if definition.ValueParts != nil {
+		activityPartValuesUpdate(lb, definition, values, value)
+	}
+	return value, nil
+}
+
+// Track the last value for each part of an activity value, changed parts
+// are stored to disk. Invalid parts are left to the handlers to report.
+func activityPartValuesUpdate(lb *LoadBalancerContext, definition *ActivityDefinition, values *activityValues, value string) {
+	parts, err := definition.ValueParts(value)
+	if err != nil {
+		logger.Printf("Error splitting value for %s %s\n", definition.Name, err.Error())
+	}
+	for name, partValue := range parts {
+		if partValue == values.lastPartValues[name] {
+			continue
+		}
+		values.lastPartValues[name] = partValue
+		if definition.ValueFile != "" {
+			storeActivityValue(lb.runDirectory(), activityPartValueFile(definition.ValueFile, name), partValue)
+		}
+	}
+}
+
+// The value file name for a named part of an activity value
+func activityPartValueFile(valueFile string, name string) string {
+	return fmt.Sprintf("%s-%s", valueFile, url.PathEscape(name))
+}
+
+// Remove an activity value stored to disk by name
+func removeActivityValue(directory string, name string) {
+	err := os.Remove(fmt.Sprintf("%s/%s.xml", directory, name))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Printf("Error removing value file %s\n", err.Error())
+	}
+}
+
 // Store an activity value to disk by name.
 // Assumes all activity values are XML
-func storeActivityValue(name string, value string) {
-	activityValueOut, err := os.Create(fmt.Sprintf("%s/%s.xml", *runDir, name))
+func storeActivityValue(directory string, name string, value string) {
+	activityValueOut, err := os.Create(fmt.Sprintf("%s/%s.xml", directory, name))
 	if err == nil {
 		defer activityValueOut.Close()
 		_, err = activityValueOut.WriteString(value)
@@ -237,58 +683,93 @@ func storeActivityValue(name string, value string) {
 	}
 }
 
-func configurationOutputEnhance(baseHandler ActivityHandler) (handler ActivityHandler) {
-	if *configurationTemplate != "" {
-		configPath := *configurationTemplate
-		outputPath := *configurationOutput
-		if outputPath == "" {
-			outputPath = fmt.Sprintf("%s/%s", *runDir, "loadbalancer-haproxy.conf")
-		}
-		handler = NewCompositeHandler(
-			baseHandler,
-			NewHaproxyConfigurationHandler(configPath, outputPath))
+// Enhance the base handler with secondary handlers for local state
+// The agent check handler must precede the configuration handler as the
+// configuration uses the agents view of backend instances. The
+// configuration handler is required so that a load balancer that cannot be
+// configured fails the activity.
+func configurationOutputEnhance(lb *LoadBalancerContext, baseHandler ActivityHandler) ActivityHandler {
+	handler := NewCompositeHandler(baseHandler, NewAgentCheckHandler(lb.Health, lb.AgentChecks))
+	if lb.Primary {
+		handler.Add(NewAccessLogHandler(AccessLogs), SecondaryBestEffort)
+		handler.Add(NewMetricsHandler(Metrics), SecondaryBestEffort)
+	}
+	if configurationHandler := lb.configurationHandler(); configurationHandler != nil {
+		handler.Add(configurationHandler, SecondaryRequired)
+	}
+	return handler
+}
+
+// Restore the load balancer state saved in the run directory
+// Backend instances are restored before the HAProxy configuration is
+// regenerated so the configuration has the last known servers.
+func restoreLoadBalancer(lb *LoadBalancerContext) {
+	lb.Policies.StateDirectory = lb.runDirectory()
+	if err := lb.Policies.LoadState(); err != nil {
+		logger.Printf("WARNING Error loading load balancer state %s\n", err.Error())
+	}
+	loadBalancer := lb.Policies.LastLoadBalancer()
+	if loadBalancer == nil {
+		return
+	}
+	logger.Printf("Restoring load balancer %s for %s\n", loadBalancer.LoadBalancerName, lb)
+	agentCheckHandler := &AgentCheckHandler{State: lb.Health, Servers: lb.AgentChecks}
+	if err := agentCheckHandler.ConfigureLoadBalancer(*loadBalancer); err != nil {
+		logger.Printf("Error restoring agent checks %s\n", err.Error())
+	}
+	configurationHandler := lb.configurationHandler()
+	if configurationHandler == nil {
+		return
+	}
+	if _, err := configurationHandler.Restore(); err != nil {
+		logger.Printf("ERROR Restoring HAProxy configuration %s\n", err.Error())
 	} else {
-		handler = baseHandler
+		logger.Printf("Restored HAProxy configuration for load balancer %s\n", loadBalancer.LoadBalancerName)
 	}
-	return
 }
 
 // Handle cache for an activity value.
 // The value may be a full activity value or its SHA-1 hash
-func activityValueCache(activity string, value string) string {
-	valueCache := ActivityValuesBySha1[activity]
-	valueSha1 := value
-	if match, err := regexp.MatchString("[0-9a-fA-F]{40}", value); err == nil && match {
-		cachedValue, ok := valueCache[value]
-		if ok {
-			logger.Printf("Using cached value for %s\n", activity)
-			value = cachedValue.Value
-		} else {
-			value = ""
-		}
-	} else {
-		logger.Printf("Caching value for %s\n", activity)
+func activityValueCache(definition *ActivityDefinition, values *activityValues, value string) string {
+	value, valueSha1 := activityValueResolve(values, value)
+	if valueSha1 == value {
+		logger.Printf("Caching value for %s\n", definition.Name)
 		valueSha1 = fmt.Sprintf("%x", sha1.Sum([]byte(value)))
+	} else if value != "" {
+		logger.Printf("Using cached value for %s\n", definition.Name)
 	}
 	timeNow := time.Now()
 	if value != "" {
+		valueCache := values.valuesBySha1
 		valueCache[valueSha1] = CachedValue{timeNow, value}
 	}
-	cacheMaintain(activity, timeNow)
+	cacheMaintain(definition, values, timeNow)
 	return value
 }
 
+// Resolve a value that may be the SHA-1 of a cached value, empty if the
+// SHA-1 is not cached. The SHA-1 is the value if it is not a reference.
+func activityValueResolve(values *activityValues, value string) (string, string) {
+	if match, err := regexp.MatchString("[0-9a-fA-F]{40}", value); err == nil && match {
+		if cachedValue, ok := values.valuesBySha1[value]; ok {
+			return cachedValue.Value, value
+		}
+		return "", value
+	}
+	return value, value
+}
+
 // Maintain the cache by removing stale keys
-func cacheMaintain(activity string, timeNow time.Time) {
-	valueCache := ActivityValuesBySha1[activity]
+func cacheMaintain(definition *ActivityDefinition, values *activityValues, timeNow time.Time) {
+	valueCache := values.valuesBySha1
 	staleKeys := make(map[string]bool)
 	for key, cachedValue := range valueCache {
-		if timeNow.Second() > (cachedValue.Time.Second() + ActivityCacheSeconds) {
+		if timeNow.Sub(cachedValue.Time) > seconds(ActivityCacheSeconds) {
 			staleKeys[key] = true
 		}
 	}
 	for staleKey := range staleKeys {
-		logger.Printf("Removing stale key for %s %s\n", activity, staleKey)
+		logger.Printf("Removing stale key for %s %s\n", definition.Name, staleKey)
 		delete(valueCache, staleKey)
 	}
 }
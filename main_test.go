@@ -0,0 +1,448 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// SwfActivityClient that serves tasks from a list and records responses
+type fakeSwfClient struct {
+	mutex      sync.Mutex
+	pollErrors []error
+	tasks      []*SwfActivityTask
+	completed  map[string]*string
+	failed     map[string]string
+	categories map[string]ActivityErrorCategory
+	canceled   map[string]string
+	heartbeats map[string]int
+	cancel     bool
+}
+
+// ActivityHandler that responds to each receive after a delay
+type fakeActivityHandler struct {
+	delay time.Duration
+}
+
+// ActivityHandler that blocks on receive until closed
+type blockingActivityHandler struct {
+	closeOnce sync.Once
+	receiving chan struct{}
+	closed    chan struct{}
+}
+
+func newFakeSwfClient(tasks []*SwfActivityTask) *fakeSwfClient {
+	return &fakeSwfClient{
+		tasks:      tasks,
+		completed:  map[string]*string{},
+		failed:     map[string]string{},
+		categories: map[string]ActivityErrorCategory{},
+		canceled:   map[string]string{},
+		heartbeats: map[string]int{},
+	}
+}
+
+func (client *fakeSwfClient) RegisterDomain(_ *string, _ int) error {
+	return nil
+}
+
+func (client *fakeSwfClient) RegisterActivities(_ *string) error {
+	return nil
+}
+
+func (client *fakeSwfClient) PollTasks(ctx context.Context, _ *string, _ *string) (*SwfActivityTask, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if len(client.pollErrors) > 0 {
+		err := client.pollErrors[0]
+		client.pollErrors = client.pollErrors[1:]
+		return &SwfActivityTask{}, err
+	}
+	if len(client.tasks) == 0 {
+		select {
+		case <-ctx.Done():
+			return &SwfActivityTask{}, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+		return &SwfActivityTask{}, nil
+	}
+	task := client.tasks[0]
+	client.tasks = client.tasks[1:]
+	return task, nil
+}
+
+func (client *fakeSwfClient) RespondTaskComplete(token string, result *string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.completed[token] = result
+	return nil
+}
+
+func (client *fakeSwfClient) RespondTaskFailed(token string, failure error) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.failed[token] = failure.Error()
+	client.categories[token] = ActivityErrorCategoryOf(failure)
+	return nil
+}
+
+func (client *fakeSwfClient) RespondTaskCanceled(token string, details string) error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.canceled[token] = details
+	return nil
+}
+
+func (client *fakeSwfClient) RecordHeartbeat(token string) (bool, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.heartbeats[token]++
+	return client.cancel, nil
+}
+
+func (client *fakeSwfClient) remaining() int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return len(client.tasks)
+}
+
+func (handler *fakeActivityHandler) Send(_ string, _ string) error {
+	return nil
+}
+
+func (handler *fakeActivityHandler) Receive(name string) (*string, error) {
+	time.Sleep(handler.delay)
+	result := fmt.Sprintf("result-%s", name)
+	return &result, nil
+}
+
+func (handler *fakeActivityHandler) Close() {
+}
+
+func (handler *blockingActivityHandler) Send(_ string, _ string) error {
+	return nil
+}
+
+func (handler *blockingActivityHandler) Receive(_ string) (*string, error) {
+	close(handler.receiving)
+	<-handler.closed
+	return nil, errors.New("handler closed")
+}
+
+func (handler *blockingActivityHandler) Close() {
+	handler.closeOnce.Do(func() { close(handler.closed) })
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	logOutput := ioutil.Discard
+	if testing.Verbose() {
+		logOutput = os.Stderr
+	}
+	logger = log.New(logOutput, "", log.Ldate|log.Ltime|log.Lshortfile)
+	os.Exit(m.Run())
+}
+
+func activityTask(token string, activity string, parameter *string) *SwfActivityTask {
+	return &SwfActivityTask{Token: &token, Name: &activity, Parameter: parameter}
+}
+
+// Run with the race detector to verify activity state is safe for concurrent use
+func TestConcurrentPolling(t *testing.T) {
+	testRunDir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatalf("TempDir error; %s", err.Error())
+	}
+	defer os.RemoveAll(testRunDir)
+	savedRunDir, savedFactory := *runDir, ActivityHandlerFactory
+	defer func() { *runDir, ActivityHandlerFactory = savedRunDir, savedFactory }()
+	*runDir = testRunDir
+	ActivityHandlerFactory = func() (ActivityHandler, error) {
+		return &fakeActivityHandler{time.Millisecond}, nil
+	}
+
+	DefaultLoadBalancer.valuesMutex.Lock()
+	DefaultLoadBalancer.values = nil
+	DefaultLoadBalancer.valuesMutex.Unlock()
+
+	loadBalancer, policy := ExampleLoadBalancer, ExamplePolicy
+	var tasks []*SwfActivityTask
+	for index := 0; index < 25; index++ {
+		tasks = append(tasks,
+			activityTask(fmt.Sprintf("status-%d", index), "LoadBalancingVmActivities.getInstanceStatus", nil),
+			activityTask(fmt.Sprintf("policy-%d", index), "LoadBalancingVmActivities.setPolicy", &policy),
+			activityTask(fmt.Sprintf("loadbalancer-%d", index), "LoadBalancingVmActivities.setLoadBalancer", &loadBalancer),
+			activityTask(fmt.Sprintf("metrics-%d", index), "LoadBalancingVmActivities.getCloudWatchMetrics", nil))
+	}
+	client := newFakeSwfClient(tasks)
+
+	var pollers sync.WaitGroup
+	for poller := 0; poller < 4; poller++ {
+		pollers.Add(1)
+		go func() {
+			defer pollers.Done()
+			for client.remaining() > 0 {
+				_ = pollActivityTask(context.Background(), client, DefaultLoadBalancer)
+			}
+		}()
+	}
+	pollers.Wait()
+
+	assert.Equal(t, 0, len(client.failed), "failed tasks")
+	assert.Equal(t, len(tasks), len(client.completed), "completed tasks")
+	assert.Equal(t, "result-get-instance-status", value(client.completed["status-0"]), "status-0 result")
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/loadbalancer.xml", testRunDir))
+	assert.NoError(t, err, "ReadFile(loadbalancer.xml)")
+	assert.Equal(t, ExampleLoadBalancer, string(data), "loadbalancer.xml")
+}
+
+// A slow activity must not prevent other pollers from handling tasks
+func TestConcurrentPollingSlowActivity(t *testing.T) {
+	savedFactory := ActivityHandlerFactory
+	defer func() { ActivityHandlerFactory = savedFactory }()
+	release := make(chan string)
+	ActivityHandlerFactory = func() (ActivityHandler, error) {
+		return NewChannelHandler(map[string]chan string{
+			"get-instance-status":    release,
+			"get-cloudwatch-metrics": make(chan string, 2),
+		}), nil
+	}
+	client := newFakeSwfClient([]*SwfActivityTask{
+		activityTask("status", "LoadBalancingVmActivities.getInstanceStatus", nil),
+		activityTask("metrics", "LoadBalancingVmActivities.getCloudWatchMetrics", nil),
+	})
+	done := make(chan struct{})
+	go func() {
+		_ = pollActivityTask(context.Background(), client, DefaultLoadBalancer)
+		close(done)
+	}()
+	assert.Equal(t, "GetInstanceStatus", <-release, "getInstanceStatus sent value")
+	_ = pollActivityTask(context.Background(), client, DefaultLoadBalancer)
+	select {
+	case <-done:
+		t.Fatal("getInstanceStatus completed before release")
+	default:
+	}
+	release <- "status"
+	<-done
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	assert.Equal(t, 2, len(client.completed), "completed tasks")
+}
+
+func TestActivityValueCache(t *testing.T) {
+	DefaultLoadBalancer.valuesMutex.Lock()
+	defer DefaultLoadBalancer.valuesMutex.Unlock()
+	activity, _ := Activities.Get("LoadBalancingVmActivities.setPolicy")
+	values := DefaultLoadBalancer.activityValues(activity)
+	cached := activityValueCache(activity, values, ExamplePolicy)
+	assert.Equal(t, ExamplePolicy, cached, "activityValueCache(ExamplePolicy)")
+	sha1Value := "0000000000000000000000000000000000000000"
+	assert.Equal(t, "", activityValueCache(activity, values, sha1Value), "activityValueCache(unknown)")
+
+	for key := range values.valuesBySha1 {
+		values.valuesBySha1[key] = CachedValue{time.Now().Add(-time.Hour), ExamplePolicy}
+	}
+	cacheMaintain(activity, values, time.Now())
+	assert.Equal(t, 0, len(values.valuesBySha1), "cache entries after maintain")
+}
+
+// Policies in a value are tracked and stored individually
+func TestActivityPartValues(t *testing.T) {
+	testRunDir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(testRunDir)
+	lb := NewLoadBalancerContext("domain", "tasks", testRunDir, 0)
+	activity, _ := Activities.Get("LoadBalancingVmActivities.setPolicy")
+	activityValueUpdate(lb, activity, ExamplePolicies, nil)
+	for _, policyName := range []string{"sticky", "app-sticky", "tls"} {
+		data, err := ioutil.ReadFile(fmt.Sprintf("%s/policy-%s.xml", testRunDir, policyName))
+		if assert.NoError(t, err, "ReadFile(policy-%s.xml)", policyName) {
+			policies, err := ActivityPoliciesString(string(data))
+			assert.NoError(t, err, "stored policy %s", policyName)
+			assert.Len(t, policies, 1, "stored policies for %s", policyName)
+		}
+	}
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/policy.xml", testRunDir))
+	assert.NoError(t, err, "ReadFile(policy.xml)")
+	assert.Equal(t, ExamplePolicies, string(data), "combined policy value")
+
+	updatedPolicy := strings.Replace(ExamplePolicy, "<AttributeValue>300</AttributeValue>", "<AttributeValue>600</AttributeValue>", 1)
+	activityValueUpdate(lb, activity, updatedPolicy, nil)
+	data, err = ioutil.ReadFile(fmt.Sprintf("%s/policy-sticky.xml", testRunDir))
+	assert.NoError(t, err, "ReadFile(policy-sticky.xml)")
+	assert.Contains(t, string(data), "<AttributeValue>600</AttributeValue>", "updated policy value")
+	data, err = ioutil.ReadFile(fmt.Sprintf("%s/policy.xml", testRunDir))
+	assert.NoError(t, err, "ReadFile(policy.xml)")
+	assert.Equal(t, updatedPolicy, string(data), "updated combined policy value")
+	lb.valuesMutex.Lock()
+	assert.Len(t, lb.activityValues(activity).lastPartValues, 3, "last policy values")
+	lb.valuesMutex.Unlock()
+
+	for _, policyName := range []string{"sticky", "app-sticky", "tls"} {
+		lb.Policies.Put(ActivityPolicy{PolicyName: policyName})
+	}
+	lb.Policies.OnPurge = lb.purgeActivityPartValues
+	lb.Policies.RetainOnly(map[string]string{"sticky": "sticky"})
+	for _, policyName := range []string{"app-sticky", "tls"} {
+		_, err = os.Stat(fmt.Sprintf("%s/policy-%s.xml", testRunDir, policyName))
+		assert.True(t, os.IsNotExist(err), "purged policy-%s.xml removed", policyName)
+	}
+	_, err = os.Stat(fmt.Sprintf("%s/policy-sticky.xml", testRunDir))
+	assert.NoError(t, err, "retained policy-sticky.xml")
+	lb.valuesMutex.Lock()
+	assert.Len(t, lb.activityValues(activity).lastPartValues, 1, "last policy values after purge")
+	lb.valuesMutex.Unlock()
+}
+
+// Polling stops when the context is done
+func TestPollingShutdown(t *testing.T) {
+	client := newFakeSwfClient(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		pollActivityTasks(ctx, client, DefaultLoadBalancer)
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pollActivityTasks did not return after cancel")
+	}
+}
+
+// In-flight activities complete within the shutdown deadline
+func TestShutdownInFlightActivity(t *testing.T) {
+	savedFactory, savedTimeout := ActivityHandlerFactory, *shutdownTimeout
+	defer func() { ActivityHandlerFactory, *shutdownTimeout = savedFactory, savedTimeout }()
+	*shutdownTimeout = 5
+	ActivityHandlerFactory = func() (ActivityHandler, error) {
+		return &fakeActivityHandler{100 * time.Millisecond}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	activityCtx, activityCancel := activityContext(ctx, seconds(int64(*shutdownTimeout)))
+	defer activityCancel()
+	activity, _ := Activities.Get("LoadBalancingVmActivities.getInstanceStatus")
+	result, err := doActivity(activityCtx, DefaultLoadBalancer, activity, nil, nil)
+	assert.NoError(t, err, "doActivity during shutdown deadline")
+	assert.Equal(t, "result-get-instance-status", value(result), "doActivity result")
+}
+
+// Activities with a direct result are not sent to a handler
+func TestDirectResultActivity(t *testing.T) {
+	savedFactory, savedDirect := ActivityHandlerFactory, MetricsPublishedDirectly
+	defer func() { ActivityHandlerFactory, MetricsPublishedDirectly = savedFactory, savedDirect }()
+	ActivityHandlerFactory = func() (ActivityHandler, error) {
+		return &fakeActivityHandler{}, nil
+	}
+	activity, _ := Activities.Get("LoadBalancingVmActivities.getCloudWatchMetrics")
+	MetricsPublishedDirectly = false
+	result, err := doActivity(context.Background(), DefaultLoadBalancer, activity, nil, nil)
+	assert.NoError(t, err, "doActivity with handler")
+	assert.Equal(t, "result-get-cloudwatch-metrics", value(result), "handler result")
+	MetricsPublishedDirectly = true
+	result, err = doActivity(context.Background(), DefaultLoadBalancer, activity, nil, nil)
+	assert.NoError(t, err, "doActivity with direct result")
+	assert.Equal(t, "", value(result), "direct result")
+}
+
+// In-flight activities are aborted and failed at the shutdown deadline
+func TestShutdownAbortActivity(t *testing.T) {
+	savedFactory, savedTimeout := ActivityHandlerFactory, *shutdownTimeout
+	defer func() { ActivityHandlerFactory, *shutdownTimeout = savedFactory, savedTimeout }()
+	*shutdownTimeout = 0
+	handler := &blockingActivityHandler{receiving: make(chan struct{}), closed: make(chan struct{})}
+	ActivityHandlerFactory = func() (ActivityHandler, error) {
+		return handler, nil
+	}
+	client := newFakeSwfClient([]*SwfActivityTask{
+		activityTask("status", "LoadBalancingVmActivities.getInstanceStatus", nil),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		pollActivityTasks(ctx, client, DefaultLoadBalancer)
+		close(stopped)
+	}()
+	<-handler.receiving
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pollActivityTasks did not return after shutdown deadline")
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	assert.Contains(t, client.failed["status"], "activity aborted", "failed task message")
+	assert.Equal(t, ActivityErrorTransient, client.categories["status"], "failed task category")
+}
+
+func TestHeartbeatCancelActivity(t *testing.T) {
+	savedFactory, savedTimeout := ActivityHandlerFactory, *heartbeatTimeout
+	defer func() { ActivityHandlerFactory, *heartbeatTimeout = savedFactory, savedTimeout }()
+	*heartbeatTimeout = 3
+	handler := &blockingActivityHandler{receiving: make(chan struct{}), closed: make(chan struct{})}
+	ActivityHandlerFactory = func() (ActivityHandler, error) {
+		return handler, nil
+	}
+	client := newFakeSwfClient([]*SwfActivityTask{
+		activityTask("status", "LoadBalancingVmActivities.getInstanceStatus", nil),
+	})
+	client.cancel = true
+	done := make(chan error)
+	go func() {
+		done <- pollActivityTask(context.Background(), client, DefaultLoadBalancer)
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err, "poll error")
+	case <-time.After(5 * time.Second):
+		t.Fatal("activity not canceled on heartbeat cancellation request")
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	assert.Equal(t, 1, client.heartbeats["status"], "heartbeats recorded")
+	assert.Contains(t, client.canceled, "status", "task canceled")
+	assert.NotContains(t, client.failed, "status", "task failed")
+}
+
+func TestHeartbeatActivity(t *testing.T) {
+	client := newFakeSwfClient(nil)
+	canceled := false
+	stop := startActivityHeartbeat(client, "token", 10*time.Millisecond, func() { canceled = true })
+	time.Sleep(55 * time.Millisecond)
+	assert.False(t, stop(), "cancellation requested")
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	assert.True(t, client.heartbeats["token"] >= 2, "heartbeats recorded")
+	assert.False(t, canceled, "activity canceled")
+}
+
+func TestHeartbeatInterval(t *testing.T) {
+	assert.Equal(t, DefaultHeartbeatInterval, activityHeartbeatInterval(0), "interval without timeout")
+	assert.Equal(t, 30*time.Second, activityHeartbeatInterval(90*time.Second), "interval for timeout")
+	assert.Equal(t, time.Second, activityHeartbeatInterval(time.Second), "minimum interval")
+
+	definition := &ActivityDefinition{Name: "Activities.setValue"}
+	assert.Equal(t, 90*time.Second, definition.ResolveHeartbeatTimeout(90*time.Second), "agent timeout")
+	definition.HeartbeatTimeout = "30"
+	assert.Equal(t, 30*time.Second, definition.ResolveHeartbeatTimeout(90*time.Second), "activity timeout")
+	definition.HeartbeatTimeout = "NONE"
+	assert.Equal(t, time.Duration(0), definition.ResolveHeartbeatTimeout(90*time.Second), "activity without timeout")
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ActivityVerifier verifies activity payload signatures
+var ActivityVerifier = &PayloadVerifier{Certificate: servoEucalyptusCertificate}
+
+// PayloadVerifier verifies the cloud signature for activity payloads
+// Signatures are base-64 encoded RSA PKCS #1 v1.5 SHA-256 signatures over
+// the payload using the Eucalyptus certificate key. The payload is the
+// resolved value for cached activities, the signature is the signature
+// argument for the activity version. When enabled, signed payloads must
+// verify. When strict, payloads must also be signed.
+type PayloadVerifier struct {
+	Enabled     bool
+	Strict      bool
+	Certificate func() *x509.Certificate
+}
+
+// Verify the signature for an activity payload
+func (verifier *PayloadVerifier) Verify(definition *ActivityDefinition, payload *string, signature *string) error {
+	if !(verifier.Enabled || verifier.Strict) || !definition.Signed || payload == nil {
+		return nil
+	}
+	activity := definition.Name
+	if signature == nil || *signature == "" {
+		if verifier.Strict {
+			return NewActivityError(ActivityErrorInvalidInput,
+				errors.New(fmt.Sprintf("unsigned payload for activity %s", activity)))
+		}
+		logger.Printf("WARNING Unsigned payload for activity %s\n", activity)
+		return nil
+	}
+	certificate := verifier.Certificate()
+	if certificate == nil {
+		return NewActivityError(ActivityErrorInternal,
+			errors.New(fmt.Sprintf("no certificate to verify payload for activity %s", activity)))
+	}
+	publicKey, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return NewActivityError(ActivityErrorInternal,
+			errors.New("certificate key for payload verification is not an RSA key"))
+	}
+	signatureBytes, err := base64.StdEncoding.DecodeString(*signature)
+	if err != nil {
+		return NewActivityError(ActivityErrorInvalidInput,
+			errors.New(fmt.Sprintf("invalid payload signature encoding for activity %s: %s", activity, err.Error())))
+	}
+	payloadHash := sha256.Sum256([]byte(*payload))
+	if err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, payloadHash[:], signatureBytes); err != nil {
+		return NewActivityError(ActivityErrorInvalidInput,
+			errors.New(fmt.Sprintf("payload signature verification failed for activity %s", activity)))
+	}
+	return nil
+}
+
+// The Eucalyptus certificate from the current servo credentials, if any
+func servoEucalyptusCertificate() *x509.Certificate {
+	if ServoCredentials == nil {
+		return nil
+	}
+	_, values, _ := ServoCredentials.Current()
+	if values == nil {
+		return nil
+	}
+	return values.EucalyptusCertificate
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func signTestPayload(t *testing.T, signer *testCertificate, payload string) *string {
+	payloadHash := sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signer.key, crypto.SHA256, payloadHash[:])
+	if err != nil {
+		t.Fatalf("SignPKCS1v15 error; %s", err.Error())
+	}
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	return &encoded
+}
+
+func TestPayloadVerify(t *testing.T) {
+	cloud := generateTestCertificate(t, "eucalyptus", nil)
+	other := generateTestCertificate(t, "other", nil)
+	verifier := &PayloadVerifier{
+		Enabled:     true,
+		Certificate: func() *x509.Certificate { return cloud.certificate },
+	}
+	activity := &ActivityDefinition{Name: "LoadBalancingVmActivities.setPolicy", Signed: true}
+	payload := "<PolicyDescription/>"
+	invalidEncoding := "%%%"
+
+	assert.NoError(t, verifier.Verify(activity, &payload, signTestPayload(t, cloud, payload)), "valid signature")
+	assert.Error(t, verifier.Verify(activity, &payload, signTestPayload(t, other, payload)), "other signer")
+	assert.Error(t, verifier.Verify(activity, &payload, signTestPayload(t, cloud, payload+" ")), "modified payload")
+	assert.Error(t, verifier.Verify(activity, &payload, &invalidEncoding), "invalid signature encoding")
+	assert.NoError(t, verifier.Verify(activity, &payload, nil), "unsigned payload")
+	assert.NoError(t, verifier.Verify(&ActivityDefinition{Name: "LoadBalancingVmActivities.getInstanceStatus"}, nil, nil), "unsigned activity")
+
+	verifier.Strict = true
+	assert.Error(t, verifier.Verify(activity, &payload, nil), "unsigned payload when strict")
+	assert.NoError(t, verifier.Verify(activity, &payload, signTestPayload(t, cloud, payload)), "valid signature when strict")
+
+	verifier.Certificate = func() *x509.Certificate { return nil }
+	err := verifier.Verify(activity, &payload, signTestPayload(t, cloud, payload))
+	assert.Error(t, err, "no certificate")
+	assert.Equal(t, ActivityErrorInternal, ActivityErrorCategoryOf(err), "no certificate category")
+
+	disabled := &PayloadVerifier{Certificate: verifier.Certificate}
+	assert.NoError(t, disabled.Verify(activity, &payload, &invalidEncoding), "verification disabled")
+}
+
+// Payloads failing verification are refused without reaching the handler
+func TestPayloadVerifyActivity(t *testing.T) {
+	savedVerifier, savedFactory := ActivityVerifier, ActivityHandlerFactory
+	defer func() { ActivityVerifier, ActivityHandlerFactory = savedVerifier, savedFactory }()
+	cloud := generateTestCertificate(t, "eucalyptus", nil)
+	ActivityVerifier = &PayloadVerifier{
+		Strict:      true,
+		Certificate: func() *x509.Certificate { return cloud.certificate },
+	}
+	handled := false
+	ActivityHandlerFactory = func() (ActivityHandler, error) {
+		handled = true
+		return &fakeActivityHandler{}, nil
+	}
+	payload := "<PolicyDescriptions/>"
+	task := activityTask("policy", "LoadBalancingVmActivities.setPolicy", &payload)
+	client := newFakeSwfClient([]*SwfActivityTask{task})
+	assert.NoError(t, pollActivityTask(context.Background(), client, DefaultLoadBalancer), "poll error")
+	assert.Contains(t, client.failed["policy"], "unsigned payload", "failed task message")
+	assert.Equal(t, ActivityErrorInvalidInput, client.categories["policy"], "failed task category")
+	assert.False(t, handled, "handler used for unsigned payload")
+}
+
+// The signature argument is verified for the resolved value of a cached
+// activity, values that fail verification are not cached
+func TestPayloadVerifyCachedValue(t *testing.T) {
+	savedVerifier, savedFactory := ActivityVerifier, ActivityHandlerFactory
+	defer func() { ActivityVerifier, ActivityHandlerFactory = savedVerifier, savedFactory }()
+	testRunDir, err := ioutil.TempDir("", "run")
+	if err != nil {
+		t.Fatalf("TempDir error; %s", err.Error())
+	}
+	defer os.RemoveAll(testRunDir)
+	cloud := generateTestCertificate(t, "eucalyptus", nil)
+	ActivityVerifier = &PayloadVerifier{
+		Strict:      true,
+		Certificate: func() *x509.Certificate { return cloud.certificate },
+	}
+	ActivityHandlerFactory = func() (ActivityHandler, error) {
+		return &fakeActivityHandler{}, nil
+	}
+	lb := NewLoadBalancerContext("domain", "tasks", testRunDir, 0)
+	policySha1 := sha1.Sum([]byte(ExamplePolicy))
+	policyHash := hex.EncodeToString(policySha1[:])
+	signedTask := func(token string, version string, arguments ...string) *SwfActivityTask {
+		input, err := json.Marshal([]interface{}{"java.lang.Object[]", arguments})
+		if err != nil {
+			t.Fatalf("Marshal error; %s", err.Error())
+		}
+		task := activityTask(token, "LoadBalancingVmActivities.setPolicy", nil)
+		task.Version = &version
+		task.Parameter, task.Input, task.InputError = activityTaskArguments(aws.String(string(input)))
+		return task
+	}
+	client := newFakeSwfClient([]*SwfActivityTask{
+		signedTask("unsigned", "1.0", ExamplePolicy),
+		signedTask("signed", "1.1", ExamplePolicy, *signTestPayload(t, cloud, ExamplePolicy)),
+		signedTask("reference-signed", "1.1", policyHash, *signTestPayload(t, cloud, policyHash)),
+		signedTask("reference", "1.1", policyHash, *signTestPayload(t, cloud, ExamplePolicy)),
+	})
+	for client.remaining() > 0 {
+		assert.NoError(t, pollActivityTask(context.Background(), client, lb), "poll error")
+	}
+	assert.Contains(t, client.failed["unsigned"], "unsigned payload", "version without signature argument")
+	assert.Contains(t, client.failed["reference-signed"], "verification failed", "signature for reference")
+	assert.NotContains(t, client.failed, "signed", "signed value")
+	assert.NotContains(t, client.failed, "reference", "reference to signed value")
+	assert.Len(t, client.completed, 2, "completed tasks")
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Poll error classes
+	PollErrorThrottling = "throttling"
+	PollErrorAuth       = "auth"
+	PollErrorNetwork    = "network"
+	PollErrorService    = "service"
+
+	// Circuit breaker states
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+
+	// Initial delay after a failed poll
+	PollMinBackoff = 1 * time.Second
+
+	// Maximum delay after a failed poll while the circuit is closed
+	PollMaxBackoff = 60 * time.Second
+
+	// Consecutive failures that open the circuit
+	PollCircuitThreshold = 10
+
+	// Delay while the circuit is open, before a half-open poll
+	PollCircuitOpenDuration = 5 * time.Minute
+
+	// Status section for polling
+	StatusSectionPolling = "polling"
+)
+
+// PollBreaker is the circuit breaker for activity task polling for the
+// default load balancer
+var PollBreaker = NewPollCircuitBreaker(StatusSectionPolling)
+
+// Error codes by poll error class
+var pollErrorCodes = map[string]string{
+	"Throttling":                   PollErrorThrottling,
+	"ThrottlingException":          PollErrorThrottling,
+	"RequestThrottled":             PollErrorThrottling,
+	"RequestLimitExceeded":         PollErrorThrottling,
+	"TooManyRequestsException":     PollErrorThrottling,
+	"AccessDenied":                 PollErrorAuth,
+	"AccessDeniedException":        PollErrorAuth,
+	"ExpiredToken":                 PollErrorAuth,
+	"IncompleteSignature":          PollErrorAuth,
+	"InvalidClientTokenId":         PollErrorAuth,
+	"InvalidSignatureException":    PollErrorAuth,
+	"MissingAuthenticationToken":   PollErrorAuth,
+	"OperationNotPermittedFault":   PollErrorAuth,
+	"SignatureDoesNotMatch":        PollErrorAuth,
+	"UnrecognizedClientException":  PollErrorAuth,
+	request.ErrCodeRequestError:    PollErrorNetwork,
+	request.ErrCodeResponseTimeout: PollErrorNetwork,
+	request.CanceledErrorCode:      PollErrorNetwork,
+}
+
+// PollCircuitBreaker tracks polling failures to back off and open the
+// circuit when the service is unavailable
+// A breaker is shared by the pollers for a (domain, task list) pair. Once
+// the circuit has been open for the open time a single poller makes a
+// half-open poll, other pollers wait for the result.
+type PollCircuitBreaker struct {
+	mutex         sync.Mutex
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	Threshold     int
+	OpenTime      time.Duration
+	Random        func() float64
+	Now           func() time.Time
+	StatusSection string
+	status        PollStatus
+	openUntil     time.Time
+}
+
+// PollStatus is the status output for polling
+type PollStatus struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive-failures"`
+	LastErrorClass      string `json:"last-error-class,omitempty"`
+	LastError           string `json:"last-error,omitempty"`
+	Since               string `json:"since"`
+}
+
+// Classify a polling error as throttling, auth, network or service
+func ClassifyPollError(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		if errorClass, ok := pollErrorCodes[awsErr.Code()]; ok {
+			return errorClass
+		}
+		if _, ok := awsErr.OrigErr().(net.Error); ok {
+			return PollErrorNetwork
+		}
+		return PollErrorService
+	}
+	if _, ok := err.(net.Error); ok {
+		return PollErrorNetwork
+	}
+	return PollErrorService
+}
+
+// Create a breaker with status in the given status section
+func NewPollCircuitBreaker(statusSection string) *PollCircuitBreaker {
+	return &PollCircuitBreaker{
+		MinBackoff:    PollMinBackoff,
+		MaxBackoff:    PollMaxBackoff,
+		Threshold:     PollCircuitThreshold,
+		OpenTime:      PollCircuitOpenDuration,
+		Random:        rand.Float64,
+		Now:           time.Now,
+		StatusSection: statusSection,
+		status: PollStatus{
+			State: CircuitClosed,
+			Since: time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+}
+
+// Record a successful poll, closing the circuit
+func (breaker *PollCircuitBreaker) Success() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if breaker.status.ConsecutiveFailures == 0 {
+		return
+	}
+	logger.Printf("INFO Polling recovered after %d failures, circuit %s\n",
+		breaker.status.ConsecutiveFailures, CircuitClosed)
+	breaker.setState(CircuitClosed, 0)
+}
+
+// Record a failed poll, returns the delay before the next poll
+// The delay grows exponentially with jitter until the failure threshold is
+// reached, then the circuit opens until a half-open poll is permitted.
+func (breaker *PollCircuitBreaker) Failure(err error) time.Duration {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	failures := breaker.status.ConsecutiveFailures + 1
+	errorClass := ClassifyPollError(err)
+	breaker.status.LastErrorClass = errorClass
+	breaker.status.LastError = err.Error()
+
+	state := CircuitClosed
+	delay := breaker.backoff(failures)
+	if failures >= breaker.Threshold {
+		state = CircuitOpen
+		delay = breaker.OpenTime
+		breaker.openUntil = breaker.Now().Add(delay)
+	}
+	severity := "WARNING"
+	switch {
+	case state == CircuitOpen || errorClass == PollErrorAuth:
+		severity = "ERROR"
+	case errorClass == PollErrorThrottling && failures < 3:
+		severity = "INFO"
+	}
+	if state != breaker.status.State || severity != "INFO" || failures == 1 {
+		logger.Printf("%s Polling failed (%s, %d consecutive), circuit %s, retry in %s: %s\n",
+			severity, errorClass, failures, state, delay.Round(time.Millisecond), err.Error())
+	}
+	breaker.setState(state, failures)
+	return delay
+}
+
+// Check if a poll is permitted, returns the delay before checking again if
+// not. Once the circuit has been open for the open time the first caller
+// makes a half-open poll, other callers wait while the poll is in progress.
+func (breaker *PollCircuitBreaker) BeforePoll() time.Duration {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	switch breaker.status.State {
+	case CircuitOpen:
+		if wait := breaker.openUntil.Sub(breaker.Now()); wait > 0 {
+			return wait
+		}
+		logger.Printf("WARNING Polling circuit %s, trying poll\n", CircuitHalfOpen)
+		breaker.setState(CircuitHalfOpen, breaker.status.ConsecutiveFailures)
+	case CircuitHalfOpen:
+		return breaker.MinBackoff
+	}
+	return 0
+}
+
+// Get the current polling status
+func (breaker *PollCircuitBreaker) Status() PollStatus {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	return breaker.status
+}
+
+func (breaker *PollCircuitBreaker) setState(state string, failures int) {
+	if state != breaker.status.State {
+		breaker.status.Since = breaker.Now().UTC().Format(time.RFC3339)
+	}
+	breaker.status.State = state
+	breaker.status.ConsecutiveFailures = failures
+	if failures == 0 {
+		breaker.status.LastErrorClass = ""
+		breaker.status.LastError = ""
+	}
+	Status.Set(breaker.StatusSection, breaker.status)
+}
+
+// Exponential backoff with jitter, between half and the full delay
+func (breaker *PollCircuitBreaker) backoff(failures int) time.Duration {
+	backoff := breaker.MinBackoff
+	for failure := 1; failure < failures && backoff < breaker.MaxBackoff; failure++ {
+		backoff *= 2
+	}
+	if backoff > breaker.MaxBackoff {
+		backoff = breaker.MaxBackoff
+	}
+	return backoff/2 + time.Duration(breaker.Random()*float64(backoff/2))
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClassifyPollError(t *testing.T) {
+	assert.Equal(t, PollErrorThrottling, ClassifyPollError(awserr.New("ThrottlingException", "slow down", nil)), "throttling")
+	assert.Equal(t, PollErrorAuth, ClassifyPollError(awserr.New("UnrecognizedClientException", "who", nil)), "auth")
+	assert.Equal(t, PollErrorNetwork, ClassifyPollError(awserr.New(request.ErrCodeRequestError, "send request failed", nil)), "network")
+	assert.Equal(t, PollErrorNetwork, ClassifyPollError(awserr.New("Unknown", "dial", &net.OpError{Op: "dial", Err: errors.New("refused")})), "network (cause)")
+	assert.Equal(t, PollErrorService, ClassifyPollError(awserr.New("InternalFailure", "oops", nil)), "service")
+	assert.Equal(t, PollErrorService, ClassifyPollError(errors.New("oops")), "service (other)")
+}
+
+// Polling with a failing client backs off, opens the circuit and recovers
+func TestPollBackoff(t *testing.T) {
+	var pollErrors []error
+	for index := 0; index < 4; index++ {
+		pollErrors = append(pollErrors, awserr.New(request.ErrCodeRequestError, "send request failed", nil))
+	}
+	client := newFakeSwfClient(nil)
+	client.pollErrors = pollErrors
+	breaker := NewPollCircuitBreaker(StatusSectionPolling)
+	breaker.Threshold = 3
+	breaker.Random = func() float64 { return 1.0 }
+	timeNow := time.Now()
+	breaker.Now = func() time.Time { return timeNow }
+
+	var delays []time.Duration
+	for index := 0; index < 3; index++ {
+		delays = append(delays, pollActivityTaskWithBackoff(context.Background(), breaker, client, DefaultLoadBalancer))
+	}
+	assert.Equal(t, []time.Duration{PollMinBackoff, 2 * PollMinBackoff, PollCircuitOpenDuration}, delays, "delays")
+	assert.Equal(t, CircuitOpen, breaker.Status().State, "state after threshold")
+	assert.Equal(t, PollErrorNetwork, breaker.Status().LastErrorClass, "last error class")
+	status, ok := Status.Get(StatusSectionPolling)
+	assert.True(t, ok, "polling status set")
+	assert.Equal(t, CircuitOpen, status.(PollStatus).State, "polling status state")
+
+	// polls wait while the circuit is open
+	timeNow = timeNow.Add(time.Minute)
+	assert.Equal(t, PollCircuitOpenDuration-time.Minute, breaker.BeforePoll(), "open delay")
+
+	// half-open poll fails and the circuit re-opens
+	timeNow = timeNow.Add(PollCircuitOpenDuration)
+	assert.Equal(t, PollCircuitOpenDuration, pollActivityTaskWithBackoff(context.Background(), breaker, client, DefaultLoadBalancer), "half-open failure delay")
+	assert.Equal(t, CircuitOpen, breaker.Status().State, "state after half-open failure")
+
+	// half-open poll succeeds and the circuit closes
+	timeNow = timeNow.Add(PollCircuitOpenDuration)
+	assert.Equal(t, time.Duration(0), pollActivityTaskWithBackoff(context.Background(), breaker, client, DefaultLoadBalancer), "success delay")
+	assert.Equal(t, CircuitClosed, breaker.Status().State, "state after success")
+	assert.Equal(t, 0, breaker.Status().ConsecutiveFailures, "failures after success")
+}
+
+// Only one poller makes the half-open poll, others wait for the result
+func TestPollBackoffHalfOpen(t *testing.T) {
+	breaker := NewPollCircuitBreaker("polling:domain:tasks")
+	breaker.Threshold = 1
+	timeNow := time.Now()
+	breaker.Now = func() time.Time { return timeNow }
+	assert.Equal(t, PollCircuitOpenDuration, breaker.Failure(errors.New("oops")), "open delay")
+
+	timeNow = timeNow.Add(PollCircuitOpenDuration)
+	assert.Equal(t, time.Duration(0), breaker.BeforePoll(), "half-open poll permitted")
+	assert.Equal(t, CircuitHalfOpen, breaker.Status().State, "state during half-open poll")
+	assert.Equal(t, PollMinBackoff, breaker.BeforePoll(), "second poller waits")
+	breaker.Success()
+	assert.Equal(t, time.Duration(0), breaker.BeforePoll(), "poll permitted after success")
+
+	status, ok := Status.Get("polling:domain:tasks")
+	assert.True(t, ok, "polling status set for breaker section")
+	assert.Equal(t, CircuitClosed, status.(PollStatus).State, "polling status state")
+}
+
+func TestPollBackoffJitter(t *testing.T) {
+	breaker := NewPollCircuitBreaker(StatusSectionPolling)
+	for failures := 1; failures < 20; failures++ {
+		delay := breaker.backoff(failures)
+		assert.True(t, delay >= PollMinBackoff/2 && delay <= PollMaxBackoff, "backoff(%d) = %s", failures, delay)
+	}
+	breaker.Random = func() float64 { return 0 }
+	assert.Equal(t, PollMaxBackoff/2, breaker.backoff(20), "backoff(20) minimum jitter")
+}
@@ -23,25 +23,26 @@ type RedisHandler struct {
 }
 
 // Create a new Redis ActivityHandler.
+// Redis errors are transient activity errors.
 func NewRedisHandler() (ActivityHandler, error) {
 	conn, err := redis.Dial("tcp", ":6379",
 		redis.DialConnectTimeout(seconds(60)),
 		redis.DialReadTimeout(seconds(30)))
 	if err != nil {
-		return nil, err
+		return nil, NewActivityError(ActivityErrorTransient, err)
 	}
 	return &RedisHandler{conn}, nil
 }
 
 func (handler *RedisHandler) Send(name string, value string) error {
 	_, err := handler.conn.Do(PUBLISH, name, value)
-	return err
+	return NewActivityError(ActivityErrorTransient, err)
 }
 
 func (handler *RedisHandler) Receive(name string) (*string, error) {
 	popped, err := handler.conn.Do(BLPOP, fmt.Sprintf("%s-reply", name), 0)
 	if err != nil {
-		return nil, err
+		return nil, NewActivityError(ActivityErrorTransient, err)
 	}
 	poppedArray, ok := popped.([]interface{})
 	var resultString string
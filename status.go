@@ -0,0 +1,67 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Status is the status output for the agent
+var Status = NewAgentStatus()
+
+// AgentStatus is the agents status output
+// Components set a named section of the status, the status is written to
+// the status file (if any) on each change.
+type AgentStatus struct {
+	mutex    sync.Mutex
+	Path     string
+	Updated  time.Time
+	Sections map[string]interface{}
+}
+
+func NewAgentStatus() *AgentStatus {
+	return &AgentStatus{Sections: map[string]interface{}{}}
+}
+
+// Set a status section and write the status
+func (status *AgentStatus) Set(section string, value interface{}) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	status.Sections[section] = value
+	status.Updated = time.Now()
+	if status.Path != "" {
+		if err := status.write(); err != nil {
+			logger.Printf("Error writing status %s\n", err.Error())
+		}
+	}
+}
+
+// Get a status section
+func (status *AgentStatus) Get(section string) (value interface{}, ok bool) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+	value, ok = status.Sections[section]
+	return
+}
+
+// Write the status as JSON, the file is replaced so readers never see a
+// partial status
+func (status *AgentStatus) write() error {
+	statusJson, err := json.MarshalIndent(map[string]interface{}{
+		"updated":  status.Updated.UTC().Format(time.RFC3339),
+		"sections": status.Sections,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempPath := status.Path + ".tmp"
+	if err = ioutil.WriteFile(tempPath, append(statusJson, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, status.Path)
+}
@@ -4,6 +4,8 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +13,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/swf"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
 )
 
 const (
@@ -34,126 +40,312 @@ const (
 
 	// The default schedule to close timeout for activity task registrations
 	DefaultTaskScheduleToCloseTimeout = "120"
+
+	// The time SWF holds a poll request open when no task is available
+	SwfLongPollSeconds = 60
+
+	// Idle time before a pooled connection is closed
+	HttpIdleConnectionTimeout = 90 * time.Second
+
+	// Connection timeout for service clients
+	DefaultConnectTimeout = 30 * time.Second
+
+	// Overall request timeout for service clients, including the upload of
+	// an access log file
+	DefaultRequestTimeout = 5 * time.Minute
 )
 
+// HttpProxy is the proxy for service clients
+var HttpProxy = http.ProxyFromEnvironment
+
 // Result type for activity task polling
+// The parameter is the first argument of the decoded input. The input
+// error is set for a task with input that could not be decoded.
 type SwfActivityTask struct {
-	Token     *string
-	Name      *string
-	Parameter *string
+	Token      *string
+	Name       *string
+	Version    *string
+	Parameter  *string
+	Input      *ActivityInput
+	InputError error
 }
 
 // Facade for simple activity registration and task handling
 type SwfActivityClient interface {
 
+	// Register the workflow domain with the given retention period if it
+	// does not exist, warnings are logged for a deprecated domain or a
+	// retention period mismatch
+	RegisterDomain(domain *string, retentionDays int) error
+
 	// Register the pre-defined activities under the specified workflow domain
 	RegisterActivities(domain *string) error
 
-	// Poll for an activity task
-	PollTasks(domain *string, taskList *string) (*SwfActivityTask, error)
+	// Poll for an activity task, the poll is abandoned if the context is done
+	PollTasks(ctx context.Context, domain *string, taskList *string) (*SwfActivityTask, error)
 
 	// Respond for a completed activity task
 	RespondTaskComplete(token string, result *string) error
 
-	// Respond for a failed activity task
-	RespondTaskFailed(token string, message string) error
+	// Respond for a failed activity task, the failure details have the
+	// exception class, category and retryability for the error
+	RespondTaskFailed(token string, failure error) error
+
+	// Respond for an activity task canceled on request
+	RespondTaskCanceled(token string, details string) error
+
+	// Record a heartbeat for an activity task, returns true if cancellation
+	// of the task has been requested
+	RecordHeartbeat(token string) (bool, error)
 }
 
 // Implementation of SwfActivityClient with AWS SDK client
 type SwfClient struct {
-	Client *swf.SWF
+	Client           *swf.SWF
+	PollTimeout      time.Duration
+	ResponseTimeout  time.Duration
+	HeartbeatTimeout time.Duration
+	Identity         string
+}
+
+// Connection and timeout settings for the SWF client
+// The poll timeout must be longer than the 60 second SWF long poll. The
+// heartbeat timeout is registered for activities without a heartbeat
+// timeout, zero for none. The identity is derived from the task list if
+// empty.
+type SwfClientConfig struct {
+	ConnectTimeout   time.Duration
+	MaxConnections   int
+	PollTimeout      time.Duration
+	ResponseTimeout  time.Duration
+	HeartbeatTimeout time.Duration
+	Identity         string
 }
 
 // Create a client for the given endpoint and region.
 // The client will use the default credentials locations.
-func NewSwfClient(endpoint string, region string) (SwfActivityClient, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Endpoint: aws.String(endpoint),
-		Region:   aws.String(region)},
-	)
+func NewSwfClient(endpoint string, region string, config SwfClientConfig) (SwfActivityClient, error) {
+	clientTimeout := config.PollTimeout
+	if config.ResponseTimeout > clientTimeout {
+		clientTimeout = config.ResponseTimeout
+	}
+	sess, err := NewAwsSession(endpoint, region, &aws.Config{
+		HTTPClient: NewHttpClient(config.ConnectTimeout, config.MaxConnections, clientTimeout),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var swfClient SwfActivityClient = &SwfClient{
+		swf.New(sess), config.PollTimeout, config.ResponseTimeout, config.HeartbeatTimeout, config.Identity}
+	return swfClient, nil
+}
+
+// Create an HTTP client with the given connect timeout, connection limit
+// and overall request timeout.
+// TLS connections, including connections through a proxy, use the
+// CloudTLSTrust. The connect timeout also limits the TLS handshake.
+func NewHttpClient(connectTimeout time.Duration, maxConnections int, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := CloudTLSTrust.Transport(func(tlsConfig *tls.Config) *http.Transport {
+		return &http.Transport{
+			Proxy:               HttpProxy,
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: connectTimeout,
+			MaxConnsPerHost:     maxConnections,
+			MaxIdleConnsPerHost: maxConnections,
+			IdleConnTimeout:     HttpIdleConnectionTimeout,
+		}
+	})
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
+
+// Context for a request with the given timeout, no timeout if zero
+func requestContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// Create a session for the given endpoint and region.
+// The session will use the default credentials locations. Additional
+// configuration is applied after the endpoint, region and HTTP client.
+// The HTTP client is set after the session is created as the SDK only
+// supports custom CA bundles for its own transport, the CloudTLSTrust is
+// used instead of any custom CA bundle.
+func NewAwsSession(endpoint string, region string, configs ...*aws.Config) (*session.Session, error) {
+	config := &aws.Config{
+		Endpoint:   aws.String(endpoint),
+		Region:     aws.String(region),
+		HTTPClient: NewHttpClient(DefaultConnectTimeout, 0, DefaultRequestTimeout),
+	}
+	for _, additionalConfig := range configs {
+		config.MergeIn(additionalConfig)
+	}
+	httpClient := config.HTTPClient
+	config.HTTPClient = nil
+	sess, err := session.NewSession(config)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Error creating aws session %s", err.Error()))
 	}
+	sess.Config.HTTPClient = httpClient
 
 	_, err = sess.Config.Credentials.Get()
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Error getting credentials %s", err.Error()))
 	}
-	var swfClient SwfActivityClient = &SwfClient{swf.New(sess)}
-	return swfClient, nil
+	return sess, nil
+}
+
+func (swfClient *SwfClient) RegisterDomain(domain *string, retentionDays int) error {
+	retention := strconv.Itoa(retentionDays)
+	ctx, cancel := requestContext(context.Background(), swfClient.ResponseTimeout)
+	_, err := swfClient.Client.RegisterDomainWithContext(ctx, &swf.RegisterDomainInput{
+		Name:                                   domain,
+		Description:                            aws.String(""),
+		WorkflowExecutionRetentionPeriodInDays: aws.String(retention),
+	})
+	cancel()
+	if err != nil {
+		if svcErr, ok := err.(awserr.Error); !ok || svcErr.Code() != swf.ErrCodeDomainAlreadyExistsFault {
+			return errors.New(fmt.Sprintf("Error registering domain %s: %s", aws.StringValue(domain), err.Error()))
+		}
+		logger.Printf("Domain already exists %s\n", aws.StringValue(domain))
+	} else {
+		logger.Printf("Registered domain %s with retention %s days\n", aws.StringValue(domain), retention)
+	}
+
+	ctx, cancel = requestContext(context.Background(), swfClient.ResponseTimeout)
+	defer cancel()
+	output, err := swfClient.Client.DescribeDomainWithContext(ctx, &swf.DescribeDomainInput{Name: domain})
+	if err != nil {
+		logger.Printf("WARNING Error describing domain %s: %s\n", aws.StringValue(domain), err.Error())
+		return nil
+	}
+	for _, warning := range domainWarnings(output, retention) {
+		logger.Printf("WARNING %s\n", warning)
+	}
+	return nil
+}
+
+// Warnings for a domain that is deprecated or has an unexpected retention
+func domainWarnings(description *swf.DescribeDomainOutput, retention string) []string {
+	var warnings []string
+	if description.DomainInfo == nil {
+		return warnings
+	}
+	name := aws.StringValue(description.DomainInfo.Name)
+	if aws.StringValue(description.DomainInfo.Status) == swf.RegistrationStatusDeprecated {
+		warnings = append(warnings, fmt.Sprintf("Domain %s is deprecated", name))
+	}
+	if description.Configuration != nil &&
+		aws.StringValue(description.Configuration.WorkflowExecutionRetentionPeriodInDays) != retention {
+		warnings = append(warnings, fmt.Sprintf("Domain %s retention period %s days does not match %s days",
+			name, aws.StringValue(description.Configuration.WorkflowExecutionRetentionPeriodInDays), retention))
+	}
+	return warnings
 }
 
 func (swfClient *SwfClient) RegisterActivities(domain *string) error {
-	for activityName := range ActivityChannels {
+	for _, definition := range Activities.Definitions() {
 		input := &swf.RegisterActivityTypeInput{
 			Domain:                            domain,
-			Name:                              aws.String(activityName),
-			Version:                           aws.String(ActivityVersion),
+			Name:                              aws.String(definition.Name),
+			Version:                           aws.String(definition.Version),
 			Description:                       aws.String(""),
-			DefaultTaskHeartbeatTimeout:       aws.String(DefaultTaskHeartbeatTimeout),
-			DefaultTaskStartToCloseTimeout:    aws.String(DefaultTaskStartToCloseTimeout),
-			DefaultTaskScheduleToStartTimeout: aws.String(DefaultTaskScheduleToStartTimeout),
-			DefaultTaskScheduleToCloseTimeout: aws.String(DefaultTaskScheduleToCloseTimeout),
+			DefaultTaskHeartbeatTimeout:       aws.String(swfTimeout(definition.ResolveHeartbeatTimeout(swfClient.HeartbeatTimeout), DefaultTaskHeartbeatTimeout)),
+			DefaultTaskStartToCloseTimeout:    aws.String(definition.StartToCloseTimeout),
+			DefaultTaskScheduleToStartTimeout: aws.String(definition.ScheduleToStartTimeout),
+			DefaultTaskScheduleToCloseTimeout: aws.String(definition.ScheduleToCloseTimeout),
+		}
+		if definition.TaskList != "" {
+			input.DefaultTaskList = &swf.TaskList{Name: aws.String(definition.TaskList)}
 		}
-		_, err := swfClient.Client.RegisterActivityType(input)
+		if definition.TaskPriority != "" {
+			input.DefaultTaskPriority = aws.String(definition.TaskPriority)
+		}
+		ctx, cancel := requestContext(context.Background(), swfClient.ResponseTimeout)
+		_, err := swfClient.Client.RegisterActivityTypeWithContext(ctx, input)
+		cancel()
 		if err != nil {
 			if svcErr, ok := err.(awserr.Error); ok {
 				switch svcErr.Code() {
 				case swf.ErrCodeTypeAlreadyExistsFault:
-					logger.Printf("Activity type already exists %s %s\n", activityName, ActivityVersion)
+					logger.Printf("Activity type already exists %s %s\n", definition.Name, definition.Version)
 				default:
 					return errors.New(fmt.Sprintf("Error registering activity type %s %s: %s",
-						activityName, ActivityVersion, svcErr.Error()))
+						definition.Name, definition.Version, svcErr.Error()))
 				}
 			} else {
 				return errors.New(fmt.Sprintf("Error registering activity type %s %s: %s\n",
-					activityName, ActivityVersion, err.Error()))
+					definition.Name, definition.Version, err.Error()))
 			}
 		} else {
-			logger.Printf("Registered activity type %s %s\n", activityName, ActivityVersion)
+			logger.Printf("Registered activity type %s %s\n", definition.Name, definition.Version)
 		}
 	}
 	return nil
 }
 
-func (swfClient *SwfClient) PollTasks(domain *string, taskList *string) (*SwfActivityTask, error) {
+func (swfClient *SwfClient) PollTasks(pollCtx context.Context, domain *string, taskList *string) (*SwfActivityTask, error) {
+	identity := swfClient.Identity
+	if identity == "" {
+		identity = fmt.Sprintf("client-worker-%s", *taskList)
+	}
 	input := &swf.PollForActivityTaskInput{
 		Domain: domain,
 		TaskList: &swf.TaskList{
 			Name: taskList,
 		},
-		Identity: aws.String(fmt.Sprintf("client-worker-%s", *taskList)),
+		Identity: aws.String(identity),
 	}
-	output, err := swfClient.Client.PollForActivityTask(input)
+	ctx, cancel := requestContext(pollCtx, swfClient.PollTimeout)
+	defer cancel()
+	output, err := swfClient.Client.PollForActivityTaskWithContext(ctx, input)
 	if err != nil {
 		return &SwfActivityTask{}, err
 	}
 	if output.TaskToken != nil {
-		taskToken := output.TaskToken
-		taskActivity := output.ActivityType.Name
-		var taskParams []interface{}
-		err := json.Unmarshal([]byte(*output.Input), &taskParams)
-		if err != nil {
-			return &SwfActivityTask{}, err
+		task := &SwfActivityTask{Token: output.TaskToken}
+		if output.ActivityType != nil {
+			task.Name = output.ActivityType.Name
+			task.Version = output.ActivityType.Version
 		}
-		paramsArray, ok := taskParams[1].([]interface{})
-		var parameter *string = nil
-		if ok && len(paramsArray) > 0 {
-			parameterStr := fmt.Sprintf("%s", paramsArray[0])
-			parameter = &parameterStr
+		if task.Name == nil {
+			task.InputError = errors.New("activity task has no activity type")
+			return task, nil
 		}
-		return &SwfActivityTask{taskToken, taskActivity, parameter}, nil
+		task.Parameter, task.Input, task.InputError = activityTaskArguments(output.Input)
+		return task, nil
 	}
 	return &SwfActivityTask{}, nil
 }
 
+// Decode the parameter and arguments for activity task input
+func activityTaskArguments(input *string) (parameter *string, activityInput *ActivityInput, err error) {
+	if activityInput, err = DecodeActivityInput(input); err != nil {
+		return
+	}
+	parameter, err = activityInput.StringArgument(0)
+	return
+}
+
 func (swfClient *SwfClient) RespondTaskComplete(token string, response *string) (err error) {
 	responseJson, err := json.Marshal(response)
 	if err != nil {
 		logger.Printf("Error marshalling response %s\n", err.Error())
 		return err
 	} else {
-		_, err = swfClient.Client.RespondActivityTaskCompleted(&swf.RespondActivityTaskCompletedInput{
+		ctx, cancel := requestContext(context.Background(), swfClient.ResponseTimeout)
+		defer cancel()
+		_, err = swfClient.Client.RespondActivityTaskCompletedWithContext(ctx, &swf.RespondActivityTaskCompletedInput{
 			TaskToken: &token,
 			Result:    aws.String(string(responseJson)),
 		})
@@ -161,17 +353,55 @@ func (swfClient *SwfClient) RespondTaskComplete(token string, response *string)
 	return
 }
 
-func (swfClient *SwfClient) RespondTaskFailed(token string, message string) (err error) {
-	failureList := [...]interface{}{ExceptionClass, map[string]string{ExceptionMessage: message}}
+func (swfClient *SwfClient) RespondTaskFailed(token string, failure error) (err error) {
+	message := failure.Error()
+	category := ActivityErrorCategoryOf(failure)
+	failureList := [...]interface{}{category.ExceptionClass(), map[string]interface{}{
+		ExceptionMessage:   message,
+		ExceptionCategory:  category,
+		ExceptionRetryable: category.Retryable(),
+	}}
 	failureJson, err := json.Marshal(failureList)
 	if err != nil {
 		logger.Printf("Error marshalling failure result %s\n", err.Error())
 		failureJson = []byte("'Unknown error'")
 	}
-	_, err = swfClient.Client.RespondActivityTaskFailed(&swf.RespondActivityTaskFailedInput{
+	ctx, cancel := requestContext(context.Background(), swfClient.ResponseTimeout)
+	defer cancel()
+	_, err = swfClient.Client.RespondActivityTaskFailedWithContext(ctx, &swf.RespondActivityTaskFailedInput{
 		TaskToken: &token,
-		Reason:    aws.String(message),
+		Reason:    aws.String(category.Reason(message)),
 		Details:   aws.String(string(failureJson)),
 	})
 	return
 }
+
+func (swfClient *SwfClient) RespondTaskCanceled(token string, details string) (err error) {
+	ctx, cancel := requestContext(context.Background(), swfClient.ResponseTimeout)
+	defer cancel()
+	_, err = swfClient.Client.RespondActivityTaskCanceledWithContext(ctx, &swf.RespondActivityTaskCanceledInput{
+		TaskToken: &token,
+		Details:   aws.String(details),
+	})
+	return
+}
+
+func (swfClient *SwfClient) RecordHeartbeat(token string) (bool, error) {
+	ctx, cancel := requestContext(context.Background(), swfClient.ResponseTimeout)
+	defer cancel()
+	output, err := swfClient.Client.RecordActivityTaskHeartbeatWithContext(ctx, &swf.RecordActivityTaskHeartbeatInput{
+		TaskToken: &token,
+	})
+	if err != nil {
+		return false, err
+	}
+	return aws.BoolValue(output.CancelRequested), nil
+}
+
+// Timeout in seconds for registration, the default if zero
+func swfTimeout(timeout time.Duration, defaultTimeout string) string {
+	if timeout <= 0 {
+		return defaultTimeout
+	}
+	return strconv.Itoa(int(timeout / time.Second))
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2020 Steve Jones
+// SPDX-License-Identifier: BSD-2-Clause
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/swf"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Create a client for a test endpoint using static credentials
+func testSwfClient(t *testing.T, endpoint string, config SwfClientConfig) *SwfClient {
+	sess, err := NewAwsSession(endpoint, EucalyptusRegion, &aws.Config{
+		Credentials: credentials.NewStaticCredentials("AKIAEXAMPLE", "secret", ""),
+		HTTPClient:  NewHttpClient(config.ConnectTimeout, config.MaxConnections, config.PollTimeout),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatalf("NewAwsSession error; %s", err.Error())
+	}
+	return &SwfClient{swf.New(sess), config.PollTimeout, config.ResponseTimeout, config.HeartbeatTimeout, config.Identity}
+}
+
+// A hung endpoint must not block polling or responding beyond the timeouts
+func TestSwfClientTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		select {
+		case <-request.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := testSwfClient(t, server.URL, SwfClientConfig{
+		ConnectTimeout:  time.Second,
+		MaxConnections:  2,
+		PollTimeout:     200 * time.Millisecond,
+		ResponseTimeout: 100 * time.Millisecond,
+	})
+	start := time.Now()
+	_, err := client.PollTasks(context.Background(), aws.String("domain"), aws.String("task-list"))
+	assert.Error(t, err, "PollTasks with hung endpoint")
+	assert.True(t, time.Since(start) < 5*time.Second, "PollTasks time %s", time.Since(start))
+
+	start = time.Now()
+	err = client.RespondTaskFailed("token", errors.New("message"))
+	assert.Error(t, err, "RespondTaskFailed with hung endpoint")
+	assert.True(t, time.Since(start) < 5*time.Second, "RespondTaskFailed time %s", time.Since(start))
+}
+
+func TestSwfClientRecordHeartbeat(t *testing.T) {
+	var target string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.Header.Get("X-Amz-Target")
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		_, _ = w.Write([]byte(`{"cancelRequested":true}`))
+	}))
+	defer server.Close()
+	client := testSwfClient(t, server.URL, SwfClientConfig{ResponseTimeout: 5 * time.Second})
+	cancelRequested, err := client.RecordHeartbeat("token")
+	assert.NoError(t, err, "heartbeat error")
+	assert.True(t, cancelRequested, "cancel requested")
+	assert.Equal(t, "SimpleWorkflowService.RecordActivityTaskHeartbeat", target, "request target")
+}
+
+func TestSwfClientPollIdentity(t *testing.T) {
+	var identities []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input swf.PollForActivityTaskInput
+		_ = json.NewDecoder(r.Body).Decode(&input)
+		identities = append(identities, aws.StringValue(input.Identity))
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	client := testSwfClient(t, server.URL, SwfClientConfig{PollTimeout: 5 * time.Second})
+	_, err := client.PollTasks(context.Background(), aws.String("domain"), aws.String("i-00000000"))
+	assert.NoError(t, err, "poll error")
+	client.Identity = "client-worker-i-0123456789abcdef0@10.111.10.215"
+	_, err = client.PollTasks(context.Background(), aws.String("domain"), aws.String("i-00000000"))
+	assert.NoError(t, err, "poll error")
+	assert.Equal(t, []string{
+		"client-worker-i-00000000",
+		"client-worker-i-0123456789abcdef0@10.111.10.215",
+	}, identities, "poll identities")
+}
+
+func TestSwfClientRespondTaskFailed(t *testing.T) {
+	var input swf.RespondActivityTaskFailedInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&input)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	client := testSwfClient(t, server.URL, SwfClientConfig{ResponseTimeout: 5 * time.Second})
+	err := client.RespondTaskFailed("token", NewActivityError(ActivityErrorTransient, errors.New("connection refused")))
+	assert.NoError(t, err, "respond error")
+	assert.Equal(t, "transient: connection refused", aws.StringValue(input.Reason), "failure reason")
+	var details []interface{}
+	assert.NoError(t, json.Unmarshal([]byte(aws.StringValue(input.Details)), &details), "failure details")
+	assert.Equal(t, []interface{}{TransientExceptionClass, map[string]interface{}{
+		ExceptionMessage:   "connection refused",
+		ExceptionCategory:  "transient",
+		ExceptionRetryable: true,
+	}}, details, "failure details")
+}
+
+func TestSwfTimeout(t *testing.T) {
+	assert.Equal(t, "NONE", swfTimeout(0, "NONE"), "default timeout")
+	assert.Equal(t, "120", swfTimeout(2*time.Minute, "NONE"), "timeout seconds")
+}
+
+func TestSwfClientRegisterDomain(t *testing.T) {
+	var targets []string
+	var retention string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.Header.Get("X-Amz-Target")
+		targets = append(targets, target)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch target {
+		case "SimpleWorkflowService.RegisterDomain":
+			var input swf.RegisterDomainInput
+			_ = json.NewDecoder(r.Body).Decode(&input)
+			retention = aws.StringValue(input.WorkflowExecutionRetentionPeriodInDays)
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"com.amazonaws.swf.base.model#DomainAlreadyExistsFault","message":"exists"}`))
+		case "SimpleWorkflowService.DescribeDomain":
+			_, _ = w.Write([]byte(`{"domainInfo":{"name":"lb","status":"REGISTERED"},` +
+				`"configuration":{"workflowExecutionRetentionPeriodInDays":"7"}}`))
+		}
+	}))
+	defer server.Close()
+	client := testSwfClient(t, server.URL, SwfClientConfig{ResponseTimeout: 5 * time.Second})
+	err := client.RegisterDomain(aws.String("lb"), 7)
+	assert.NoError(t, err, "register domain error")
+	assert.Equal(t, "7", retention, "retention period")
+	assert.Equal(t, []string{
+		"SimpleWorkflowService.RegisterDomain",
+		"SimpleWorkflowService.DescribeDomain",
+	}, targets, "request targets")
+}
+
+func TestSwfClientRegisterDomainError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"__type":"com.amazonaws.swf.base.model#LimitExceededFault","message":"limit"}`))
+	}))
+	defer server.Close()
+	client := testSwfClient(t, server.URL, SwfClientConfig{ResponseTimeout: 5 * time.Second})
+	err := client.RegisterDomain(aws.String("lb"), 1)
+	assert.Error(t, err, "register domain error")
+}
+
+func TestDomainWarnings(t *testing.T) {
+	description := &swf.DescribeDomainOutput{
+		DomainInfo: &swf.DomainInfo{
+			Name:   aws.String("lb"),
+			Status: aws.String(swf.RegistrationStatusRegistered),
+		},
+		Configuration: &swf.DomainConfiguration{
+			WorkflowExecutionRetentionPeriodInDays: aws.String("1"),
+		},
+	}
+	assert.Empty(t, domainWarnings(description, "1"), "warnings for matching domain")
+	description.DomainInfo.Status = aws.String(swf.RegistrationStatusDeprecated)
+	description.Configuration.WorkflowExecutionRetentionPeriodInDays = aws.String("30")
+	assert.Equal(t, []string{
+		"Domain lb is deprecated",
+		"Domain lb retention period 30 days does not match 1 days",
+	}, domainWarnings(description, "1"), "warnings for deprecated domain")
+}
+
+func TestSwfClientRegisterActivityVersions(t *testing.T) {
+	savedActivities := Activities
+	defer func() { Activities = savedActivities }()
+	Activities = NewActivityRegistry(
+		&ActivityDefinition{Name: "Activities.getValue", Channel: "get-value", Direction: ActivityOut},
+		&ActivityDefinition{Name: "Activities.getValue", Channel: "get-value", Direction: ActivityOut,
+			Version: "2.0", StartToCloseTimeout: "300", TaskList: "values", TaskPriority: "5", HeartbeatTimeout: "NONE"},
+		&ActivityDefinition{Name: "Activities.getValue", Channel: "get-value", Direction: ActivityOut,
+			Version: "3.0", HeartbeatTimeout: "20"},
+	)
+	var inputs []swf.RegisterActivityTypeInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input swf.RegisterActivityTypeInput
+		_ = json.NewDecoder(r.Body).Decode(&input)
+		inputs = append(inputs, input)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	client := testSwfClient(t, server.URL, SwfClientConfig{ResponseTimeout: 5 * time.Second, HeartbeatTimeout: time.Minute})
+	assert.NoError(t, client.RegisterActivities(aws.String("lb")), "register activities error")
+	if assert.Len(t, inputs, 3, "registrations") {
+		assert.Equal(t, "1.0", aws.StringValue(inputs[0].Version), "first version")
+		assert.Equal(t, "60", aws.StringValue(inputs[0].DefaultTaskHeartbeatTimeout), "first version agent heartbeat timeout")
+		assert.Equal(t, "NONE", aws.StringValue(inputs[1].DefaultTaskHeartbeatTimeout), "second version heartbeat timeout")
+		assert.Equal(t, "20", aws.StringValue(inputs[2].DefaultTaskHeartbeatTimeout), "third version heartbeat timeout")
+		assert.Nil(t, inputs[0].DefaultTaskList, "first version task list")
+		assert.Equal(t, "2.0", aws.StringValue(inputs[1].Version), "second version")
+		assert.Equal(t, "300", aws.StringValue(inputs[1].DefaultTaskStartToCloseTimeout), "second version timeout")
+		assert.Equal(t, "values", aws.StringValue(inputs[1].DefaultTaskList.Name), "second version task list")
+		assert.Equal(t, "5", aws.StringValue(inputs[1].DefaultTaskPriority), "second version priority")
+	}
+}
+
+// Sessions use the cloud trust with an overall request timeout
+func TestNewAwsSessionHttpClient(t *testing.T) {
+	sess, err := NewAwsSession("http://127.0.0.1:8773", EucalyptusRegion, &aws.Config{
+		Credentials: credentials.NewStaticCredentials("AKIAEXAMPLE", "secret", ""),
+	})
+	if err != nil {
+		t.Fatalf("NewAwsSession error; %s", err.Error())
+	}
+	assert.Equal(t, DefaultRequestTimeout, sess.Config.HTTPClient.Timeout, "request timeout")
+	assert.IsType(t, &cloudTransport{}, sess.Config.HTTPClient.Transport, "cloud trust transport")
+}